@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+)
+
+// ArtistNormalization configures how artist names are normalized into the
+// key used to filter and group albums, so that variants like "The Beatles",
+// "Beatles" and "the  beatles" can be treated as one artist. Leading and
+// trailing whitespace is always trimmed; the other steps are optional. The
+// zero value only trims.
+type ArtistNormalization struct {
+	CollapseSpace bool // replace runs of whitespace with a single space
+	FoldCase      bool // convert to lower case
+	StripArticle  bool // remove a leading "the", "a" or "an"
+}
+
+// leadingArticles are the words removed from the start of an artist name by
+// ArtistNormalization.StripArticle.
+var leadingArticles = []string{"the", "a", "an"}
+
+// Normalize returns the normalized key for the artist name.
+func (n ArtistNormalization) Normalize(artist string) string {
+	artist = strings.TrimSpace(artist)
+	if n.CollapseSpace {
+		artist = strings.Join(strings.Fields(artist), " ")
+	}
+	if n.StripArticle {
+		for _, article := range leadingArticles {
+			first, rest, found := strings.Cut(artist, " ")
+			if found && strings.EqualFold(first, article) && strings.TrimSpace(rest) != "" {
+				artist = strings.TrimSpace(rest)
+				break
+			}
+		}
+	}
+	if n.FoldCase {
+		artist = strings.ToLower(artist)
+	}
+	return artist
+}
+
+// parseArtistNormalization parses a comma-separated list of normalization
+// steps ("collapse", "fold" and "article"), as used by the
+// -artist-normalize flag. It returns false if a step is unknown.
+func parseArtistNormalization(s string) (ArtistNormalization, bool) {
+	var n ArtistNormalization
+	if s == "" {
+		return n, true
+	}
+	for _, step := range strings.Split(s, ",") {
+		switch strings.TrimSpace(step) {
+		case "collapse":
+			n.CollapseSpace = true
+		case "fold":
+			n.FoldCase = true
+		case "article":
+			n.StripArticle = true
+		default:
+			return ArtistNormalization{}, false
+		}
+	}
+	return n, true
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// artistLimiter limits how many albums may be created for the same artist
+// within a sliding time window.
+type artistLimiter struct {
+	limit  int
+	window time.Duration
+
+	lock      sync.Mutex
+	events    map[string][]time.Time // creation times per artist, oldest first
+	lastSweep time.Time
+}
+
+func newArtistLimiter(limit int, window time.Duration) *artistLimiter {
+	return &artistLimiter{
+		limit:  limit,
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// allow records a creation for each of artists (which may name the same
+// artist more than once) at time now and reports whether they're all
+// within the limit. If any isn't, nothing is recorded and allow also
+// returns how long until they would all be allowed, or the whole window
+// if there are more creations for one artist than the limit. Artist names
+// are compared case-insensitively.
+func (l *artistLimiter) allow(artists []string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Occasionally drop artists with no recent creations to bound memory
+	if now.Sub(l.lastSweep) >= l.window {
+		for key, times := range l.events {
+			if len(times) == 0 || now.Sub(times[len(times)-1]) >= l.window {
+				delete(l.events, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	counts := make(map[string]int, len(artists))
+	for _, artist := range artists {
+		counts[artistLimitKey(artist)]++
+	}
+	var wait time.Duration
+	for key, n := range counts {
+		times := l.events[key]
+		for len(times) > 0 && now.Sub(times[0]) >= l.window {
+			times = times[1:]
+		}
+		l.events[key] = times
+		if excess := len(times) + n - l.limit; excess > 0 {
+			// There's room once the oldest excess creations expire
+			artistWait := l.window
+			if excess <= len(times) {
+				artistWait = times[excess-1].Add(l.window).Sub(now)
+			}
+			wait = max(wait, artistWait)
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for key, n := range counts {
+		for i := 0; i < n; i++ {
+			l.events[key] = append(l.events[key], now)
+		}
+	}
+	return true, 0
+}
+
+// release removes the creations recorded by a successful call to allow
+// with the same arguments, for albums that then weren't created.
+func (l *artistLimiter) release(artists []string, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, artist := range artists {
+		key := artistLimitKey(artist)
+		times := l.events[key]
+		for i := len(times) - 1; i >= 0; i-- {
+			if times[i].Equal(now) {
+				l.events[key] = append(times[:i], times[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func artistLimitKey(artist string) string {
+	return strings.ToLower(strings.TrimSpace(artist))
+}
+
+// limitArtists applies the per-artist creation limit, if any, to creating
+// albums by artists. If the limit is exceeded it writes a 429 response
+// and returns false. Otherwise it returns a function that gives the
+// creations back, to call if the albums then aren't created.
+func (s *Server) limitArtists(w http.ResponseWriter, artists []string) (release func(), ok bool) {
+	if s.artistLimiter == nil {
+		return func() {}, true
+	}
+	now := s.now()
+	ok, wait := s.artistLimiter.allow(artists, now)
+	if !ok {
+		seconds := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		data := map[string]any{"message": "too many albums created for this artist recently"}
+		s.jsonError(w, http.StatusTooManyRequests, ErrorRateLimited, data)
+		return nil, false
+	}
+	return func() { s.artistLimiter.release(artists, now) }, true
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireAPIKey wraps next so that requests which need authentication
+// (see needsAPIKey) must have a valid API key, either as "Authorization:
+// Bearer <key>" or in an X-API-Key header. Requests without a valid key
+// get a 401 ErrorUnauthorized response.
+func (s *Server) requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.needsAPIKey(r) && !s.validAPIKey(requestAPIKey(r)) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="albums"`)
+			data := map[string]any{"message": "a valid API key is required, as a Bearer token or in X-API-Key"}
+			s.jsonError(w, http.StatusUnauthorized, ErrorUnauthorized, data)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// needsAPIKey reports whether the request must be authenticated: writes
+// and admin routes always are, and reads only if enabled with
+// WithAuthenticatedReads. Validating an album has no side effects, so it
+// counts as a read. Health checks never need a key.
+func (s *Server) needsAPIKey(r *http.Request) bool {
+	path := r.URL.EscapedPath()
+	switch {
+	case healthPaths[path]:
+		return false
+	case strings.HasPrefix(path, "/admin/"):
+		return true
+	case r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS":
+		return s.authenticatedReads
+	case path == "/albums/validate":
+		return s.authenticatedReads
+	default:
+		return true
+	}
+}
+
+// requestAPIKey returns the API key from the request's Authorization
+// (Bearer) or X-API-Key header, or "" if there isn't one.
+func requestAPIKey(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// validAPIKey reports whether key is one of the server's API keys. It
+// compares against every key in constant time, so the response time
+// doesn't reveal how much of a key was right.
+func (s *Server) validAPIKey(key string) bool {
+	valid := 0
+	for _, k := range s.apiKeys {
+		valid |= subtle.ConstantTimeCompare([]byte(key), []byte(k))
+	}
+	return key != "" && valid == 1
+}
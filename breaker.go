@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a BreakerDatabase's circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed passes calls through to the database (normal operation).
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen fails calls immediately with ErrUnavailable.
+	BreakerOpen
+
+	// BreakerHalfOpen lets a single trial call through to test whether the
+	// database has recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerDatabase is a Database decorator that stops calling a failing
+// database for a while, so an outage doesn't tie up every request waiting
+// on it.
+//
+// After threshold consecutive failures the breaker opens, and calls fail
+// fast with ErrUnavailable. Once the cooldown has passed, the next call is
+// let through as a trial: if it succeeds the breaker closes, otherwise it
+// opens again for another cooldown. Errors that describe the data rather
+// than the database (such as ErrDoesNotExist) don't count as failures.
+type BreakerDatabase struct {
+	db        Database
+	threshold int
+	cooldown  time.Duration
+
+	lock     sync.Mutex
+	state    BreakerState
+	failures int       // consecutive failures while closed
+	openedAt time.Time // when the breaker last opened
+}
+
+// NewBreakerDatabase wraps db in a circuit breaker that opens after
+// threshold consecutive failures and stays open for cooldown.
+func NewBreakerDatabase(db Database, threshold int, cooldown time.Duration) *BreakerDatabase {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &BreakerDatabase{db: db, threshold: threshold, cooldown: cooldown}
+}
+
+// State returns the breaker's current state.
+func (d *BreakerDatabase) State() BreakerState {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.state == BreakerOpen && time.Since(d.openedAt) >= d.cooldown {
+		return BreakerHalfOpen
+	}
+	return d.state
+}
+
+// allow reports whether a call may go through to the database, and
+// whether it's the trial call of a half-open breaker.
+func (d *BreakerDatabase) allow() (ok, trial bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	switch d.state {
+	case BreakerOpen:
+		if time.Since(d.openedAt) < d.cooldown {
+			return false, false
+		}
+		d.state = BreakerHalfOpen // this call is the trial
+		return true, true
+	case BreakerHalfOpen:
+		return false, false // a trial call is already in flight
+	default:
+		return true, false
+	}
+}
+
+// record updates the breaker with the outcome of a call. Only the trial
+// call decides whether a half-open breaker closes or opens again; other
+// calls only count while the breaker is closed, so that a slow call let
+// through before the breaker opened can't close it when it finishes.
+func (d *BreakerDatabase) record(trial bool, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	switch {
+	case trial && !isDatabaseFailure(err):
+		d.state = BreakerClosed
+		d.failures = 0
+	case trial:
+		d.open()
+	case d.state != BreakerClosed:
+		// A call from before the breaker opened
+	case !isDatabaseFailure(err):
+		d.failures = 0
+	default:
+		d.failures++
+		if d.failures >= d.threshold {
+			d.open()
+		}
+	}
+}
+
+// recordUnless is record for a call that runs a callback: if the call
+// failed with fnErr, the error the callback returned, it counts as a
+// success, as the database did its part.
+func (d *BreakerDatabase) recordUnless(trial bool, err, fnErr error) {
+	if err != nil && err == fnErr {
+		err = nil
+	}
+	d.record(trial, err)
+}
+
+// open opens the breaker. The caller must hold d.lock.
+func (d *BreakerDatabase) open() {
+	d.state = BreakerOpen
+	d.openedAt = time.Now()
+	d.failures = 0
+}
+
+// isDatabaseFailure reports whether err indicates a problem with the
+// database itself, as opposed to a normal result like ErrDoesNotExist or
+// the caller giving up (context.Canceled).
+func isDatabaseFailure(err error) bool {
+	return err != nil &&
+		!errors.Is(err, context.Canceled) &&
+		!errors.Is(err, ErrDoesNotExist) &&
+		!errors.Is(err, ErrAlreadyExists) &&
+		!errors.Is(err, ErrTrackMismatch) &&
+		!errors.Is(err, ErrTooManyTracks) &&
+		!errors.Is(err, ErrVersionConflict)
+}
+
+// errPanicked is recorded as the outcome of a call that panicked, so that
+// a panicking trial call opens the breaker again rather than leaving it
+// half-open for good.
+var errPanicked = errors.New("database call panicked")
+
+// call runs op through the breaker.
+func (d *BreakerDatabase) call(op func() error) (err error) {
+	ok, trial := d.allow()
+	if !ok {
+		return ErrUnavailable
+	}
+	err = errPanicked // until op returns
+	defer func() { d.record(trial, err) }()
+	return op()
+}
+
+func (d *BreakerDatabase) GetAlbums(ctx context.Context) ([]Album, error) {
+	var albums []Album
+	err := d.call(func() error {
+		var err error
+		albums, err = d.db.GetAlbums(ctx)
+		return err
+	})
+	return albums, err
+}
+
+func (d *BreakerDatabase) GetAlbumsPage(ctx context.Context, offset, limit int) ([]Album, int, error) {
+	var albums []Album
+	var total int
+	err := d.call(func() error {
+		var err error
+		albums, total, err = d.db.GetAlbumsPage(ctx, offset, limit)
+		return err
+	})
+	return albums, total, err
+}
+
+func (d *BreakerDatabase) GetAlbumsFiltered(ctx context.Context, filter AlbumFilter) ([]Album, error) {
+	var albums []Album
+	err := d.call(func() error {
+		var err error
+		albums, err = d.db.GetAlbumsFiltered(ctx, filter)
+		return err
+	})
+	return albums, err
+}
+
+func (d *BreakerDatabase) CountAlbums(ctx context.Context, filter AlbumFilter) (int, error) {
+	var n int
+	err := d.call(func() error {
+		var err error
+		n, err = d.db.CountAlbums(ctx, filter)
+		return err
+	})
+	return n, err
+}
+
+// EachAlbum counts a failure to read the albums, but not an error returned
+// by fn.
+func (d *BreakerDatabase) EachAlbum(ctx context.Context, query AlbumQuery, fn func(Album) error) (err error) {
+	ok, trial := d.allow()
+	if !ok {
+		return ErrUnavailable
+	}
+	var fnErr error
+	err = errPanicked // until EachAlbum returns
+	defer func() { d.recordUnless(trial, err, fnErr) }()
+	return d.db.EachAlbum(ctx, query, func(album Album) error {
+		fnErr = fn(album)
+		return fnErr
+	})
+}
+
+func (d *BreakerDatabase) GetAlbumsByArtist(ctx context.Context, artist string) ([]Album, error) {
+	var albums []Album
+	err := d.call(func() error {
+		var err error
+		albums, err = d.db.GetAlbumsByArtist(ctx, artist)
+		return err
+	})
+	return albums, err
+}
+
+func (d *BreakerDatabase) GetAlbumByID(ctx context.Context, id string) (Album, error) {
+	var album Album
+	err := d.call(func() error {
+		var err error
+		album, err = d.db.GetAlbumByID(ctx, id)
+		return err
+	})
+	return album, err
+}
+
+func (d *BreakerDatabase) AddAlbum(ctx context.Context, album Album) error {
+	return d.call(func() error {
+		return d.db.AddAlbum(ctx, album)
+	})
+}
+
+func (d *BreakerDatabase) UpdateAlbum(ctx context.Context, album Album, version int) error {
+	return d.call(func() error {
+		return d.db.UpdateAlbum(ctx, album, version)
+	})
+}
+
+func (d *BreakerDatabase) DeleteAlbum(ctx context.Context, id string) error {
+	return d.call(func() error {
+		return d.db.DeleteAlbum(ctx, id)
+	})
+}
+
+func (d *BreakerDatabase) GetTracks(ctx context.Context, albumID string) ([]Track, error) {
+	var tracks []Track
+	err := d.call(func() error {
+		var err error
+		tracks, err = d.db.GetTracks(ctx, albumID)
+		return err
+	})
+	return tracks, err
+}
+
+func (d *BreakerDatabase) AddTrack(ctx context.Context, albumID string, track Track, maxTracks int) (Track, error) {
+	var added Track
+	err := d.call(func() error {
+		var err error
+		added, err = d.db.AddTrack(ctx, albumID, track, maxTracks)
+		return err
+	})
+	return added, err
+}
+
+func (d *BreakerDatabase) ReorderTracks(ctx context.Context, albumID string, trackIDs []string) error {
+	return d.call(func() error {
+		return d.db.ReorderTracks(ctx, albumID, trackIDs)
+	})
+}
+
+func (d *BreakerDatabase) Ping(ctx context.Context) error {
+	return d.call(func() error {
+		return d.db.Ping(ctx)
+	})
+}
+
+// WithTx counts a failure to run or commit the transaction, but not an
+// error returned by fn itself, which is the caller's decision to abort.
+func (d *BreakerDatabase) WithTx(ctx context.Context, fn func(tx Database) error) (err error) {
+	ok, trial := d.allow()
+	if !ok {
+		return ErrUnavailable
+	}
+	var fnErr error
+	err = errPanicked // until WithTx returns
+	defer func() { d.recordUnless(trial, err, fnErr) }()
+	return d.db.WithTx(ctx, func(tx Database) error {
+		fnErr = fn(tx)
+		return fnErr
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var errDown = errors.New("database is down")
+
+func TestBreakerOpens(t *testing.T) {
+	ctx := context.Background()
+	flaky := newFlakyDatabase(newTestDB(t), 3, errDown)
+	db := NewBreakerDatabase(flaky, 3, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		if err := db.Ping(ctx); !errors.Is(err, errDown) {
+			t.Fatalf("call %d: got error %v, want %v", i+1, err, errDown)
+		}
+	}
+	if state := db.State(); state != BreakerOpen {
+		t.Fatalf("got state %s after 3 failures, want %s", state, BreakerOpen)
+	}
+	if err := db.Ping(ctx); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("got error %v from open breaker, want %v", err, ErrUnavailable)
+	}
+	if calls := flaky.calls.Load(); calls != 3 {
+		t.Errorf("open breaker called the database: got %d calls, want 3", calls)
+	}
+}
+
+func TestBreakerIgnoresDataErrors(t *testing.T) {
+	ctx := context.Background()
+	db := NewBreakerDatabase(newTestDB(t), 2, time.Hour)
+	for i := 0; i < 5; i++ {
+		if _, err := db.GetAlbumByID(ctx, "missing"); !errors.Is(err, ErrDoesNotExist) {
+			t.Fatalf("got error %v, want %v", err, ErrDoesNotExist)
+		}
+	}
+	if state := db.State(); state != BreakerClosed {
+		t.Errorf("got state %s after not-found errors, want %s", state, BreakerClosed)
+	}
+}
+
+func TestBreakerTrial(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int // including the 2 that open the breaker
+		state    BreakerState
+	}{
+		{"trial succeeds", 2, BreakerClosed},
+		{"trial fails", 3, BreakerOpen},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			flaky := newFlakyDatabase(newTestDB(t), test.failures, errDown)
+			db := NewBreakerDatabase(flaky, 2, 0) // no cooldown: the next call is the trial
+			db.Ping(ctx)
+			db.Ping(ctx)
+			if state := db.State(); state != BreakerHalfOpen {
+				t.Fatalf("got state %s after cooldown, want %s", state, BreakerHalfOpen)
+			}
+			db.Ping(ctx)
+			db.lock.Lock()
+			state := db.state
+			db.lock.Unlock()
+			if state != test.state {
+				t.Errorf("got state %s after trial, want %s", state, test.state)
+			}
+		})
+	}
+}
+
+func TestBreakerLateSuccess(t *testing.T) {
+	ctx := context.Background()
+	flaky := newFlakyDatabase(newTestDB(t), 0, errDown)
+	flaky.entered = make(chan struct{})
+	flaky.block = make(chan struct{})
+	db := NewBreakerDatabase(flaky, 2, time.Hour)
+
+	done := make(chan error)
+	go func() {
+		_, err := db.GetAlbums(ctx)
+		done <- err
+	}()
+	<-flaky.entered // a slow call, let through while the breaker was closed
+
+	flaky.failures.Store(2)
+	db.Ping(ctx)
+	db.Ping(ctx)
+	if state := db.State(); state != BreakerOpen {
+		t.Fatalf("got state %s after 2 failures, want %s", state, BreakerOpen)
+	}
+	close(flaky.block)
+	if err := <-done; err != nil {
+		t.Fatalf("slow call: %v", err)
+	}
+	if state := db.State(); state != BreakerOpen {
+		t.Errorf("got state %s after the slow call succeeded, want %s", state, BreakerOpen)
+	}
+}
+
+func TestBreakerPanic(t *testing.T) {
+	ctx := context.Background()
+	db := NewBreakerDatabase(panickyDatabase{newTestDB(t), "boom"}, 1, 0)
+	state := func() BreakerState {
+		db.lock.Lock()
+		defer db.lock.Unlock()
+		return db.state
+	}
+	tests := []struct {
+		name string
+		call func()
+	}{
+		{"call", func() { db.GetAlbumByID(ctx, "a1") }},
+		{"trial call", func() { db.GetAlbumByID(ctx, "a1") }},
+		{"trial transaction", func() {
+			db.WithTx(ctx, func(tx Database) error { panic("boom") })
+		}},
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: didn't panic", test.name)
+				}
+			}()
+			test.call()
+		}()
+		if got := state(); got != BreakerOpen {
+			t.Errorf("got state %s after a panicking %s, want %s", got, test.name, BreakerOpen)
+		}
+	}
+	if err := db.Ping(ctx); err != nil {
+		t.Fatalf("trial ping: %v", err)
+	}
+	if got := state(); got != BreakerClosed {
+		t.Errorf("got state %s after a successful trial, want %s", got, BreakerClosed)
+	}
+}
+
+func TestBreakerStateGauge(t *testing.T) {
+	flaky := newFlakyDatabase(newTestDB(t), 1, errDown)
+	db := NewBreakerDatabase(flaky, 1, time.Hour)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewBreakerStateGauge(db))
+
+	gauge := func() float64 {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return families[0].GetMetric()[0].GetGauge().GetValue()
+	}
+	if got := gauge(); got != float64(BreakerClosed) {
+		t.Errorf("got %v for a closed breaker, want %v", got, float64(BreakerClosed))
+	}
+	db.Ping(context.Background())
+	if got := gauge(); got != float64(BreakerOpen) {
+		t.Errorf("got %v for an open breaker, want %v", got, float64(BreakerOpen))
+	}
+}
+
+func TestBreakerUnavailable(t *testing.T) {
+	flaky := newFlakyDatabase(newTestDB(t), 2, errDown)
+	h := newServerFor(NewBreakerDatabase(flaky, 2, time.Hour))
+	tests := []struct {
+		status int
+		code   string
+	}{
+		{http.StatusInternalServerError, ErrorDatabase},
+		{http.StatusInternalServerError, ErrorDatabase},
+		{http.StatusServiceUnavailable, ErrorUnavailable},
+	}
+	for i, test := range tests {
+		w := serve(h, "GET", "/albums/a1", "")
+		if w.Code != test.status || !strings.Contains(w.Body.String(), `"`+test.code+`"`) {
+			t.Errorf("request %d: got status %d and body %s, want %d with %s", i+1, w.Code, w.Body, test.status, test.code)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// bodyIsArray reports whether the request body is a JSON array, by peeking
+// at its first byte other than whitespace (or a UTF-8 byte order mark). The
+// peeked bytes are still read by the handler, as r.Body is replaced with a
+// reader that starts with them.
+func bodyIsArray(r *http.Request) bool {
+	br := bufio.NewReader(r.Body)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, r.Body}
+	for i := 1; ; i++ {
+		b, err := br.Peek(i)
+		if err != nil {
+			return false // empty body, or a buffer full of whitespace
+		}
+		switch c := b[i-1]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+		case i <= 3 && c == "\xef\xbb\xbf"[i-1]:
+		default:
+			return c == '['
+		}
+	}
+}
+
+// addAlbums adds all the albums in a request body that's a JSON array of
+// albums, writing 201 Created with the list of albums added. Albums without
+// an ID get a generated one, as with a single album. It's all or
+// nothing: partial success isn't allowed. If any album is invalid it
+// writes 400 with the validation issues keyed by index in the array (as
+// a string, like "2"), and if any can't be added, such as because the ID
+// is taken, none are. The per-artist creation limit counts every album in
+// the batch, but only if the batch is added. OnBeforeWrite hooks are
+// called for each album only once the batch has passed these checks, and
+// if a hook rejects any album, none are added.
+func (s *Server) addAlbums(w http.ResponseWriter, r *http.Request) {
+	var bodies []albumInput
+	if !s.readJSON(w, r, &bodies) {
+		return
+	}
+	if len(bodies) == 0 {
+		issues := map[string]any{"albums": validationIssue{"required", "at least one album is required"}}
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
+		return
+	}
+
+	now := s.now().UTC()
+	albums := make([]Album, len(bodies))
+	issues := map[string]any{}
+	seen := make(map[string]bool, len(bodies))
+	for i, body := range bodies {
+		album, hasPrice := s.fromInput(body)
+		if album.ID == "" {
+			album.ID = s.newID()
+		}
+		album.Version = 1 // as AddAlbum stores it
+		album.CreatedAt, album.UpdatedAt = now, now
+		albums[i] = album
+		albumIssues := s.validate(album, hasPrice)
+		if album.ID != "" && seen[album.ID] {
+			albumIssues["id"] = validationIssue{"duplicate", "an earlier album in the list has the same ID"}
+		}
+		seen[album.ID] = true
+		if len(albumIssues) > 0 {
+			issues[strconv.Itoa(i)] = albumIssues
+		}
+	}
+	if len(issues) > 0 {
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
+		return
+	}
+
+	artists := make([]string, len(albums))
+	for i, album := range albums {
+		artists[i] = album.ArtistKey
+	}
+	release, ok := s.limitArtists(w, artists)
+	if !ok {
+		return
+	}
+
+	// Check for taken IDs before calling any hooks, so they're only called
+	// for a batch that will be attempted. The transaction still checks, as
+	// another request may add one of the IDs in the meantime.
+	for i, album := range albums {
+		_, err := s.db.GetAlbumByID(r.Context(), album.ID)
+		if err == nil {
+			release()
+			s.albumsConflict(w, i, album.ID)
+			return
+		} else if !errors.Is(err, ErrDoesNotExist) {
+			release()
+			s.logger(r).Error("error fetching album", "id", album.ID, "error", err)
+			s.databaseError(w, err)
+			return
+		}
+	}
+	for _, album := range albums {
+		if !s.beforeWrite(w, r, ActionAdd, album) {
+			release()
+			return
+		}
+	}
+
+	failed := -1
+	err := s.db.WithTx(r.Context(), func(tx Database) error {
+		for i, album := range albums {
+			if err := tx.AddAlbum(r.Context(), album); err != nil {
+				failed = i
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		release()
+	}
+	if errors.Is(err, ErrAlreadyExists) {
+		s.albumsConflict(w, failed, albums[failed].ID)
+		return
+	} else if err != nil {
+		s.logger(r).Error("error adding albums", "count", len(albums), "error", err)
+		s.databaseError(w, err)
+		return
+	}
+	for _, album := range albums {
+		s.hooks.OnAfterWrite(r.Context(), ActionAdd, album)
+	}
+
+	s.writeResponse(w, r, http.StatusCreated, albums)
+}
+
+// albumsConflict writes the 409 response for a bulk add in which the album
+// at index has an ID that's already taken.
+func (s *Server) albumsConflict(w http.ResponseWriter, index int, id string) {
+	data := map[string]any{"index": index, "id": id}
+	s.jsonError(w, http.StatusConflict, ErrorAlreadyExists, data)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientLimiter is a token-bucket rate limiter per client: each client's
+// bucket holds up to burst tokens and refills at rate tokens per second,
+// and each request takes one.
+type clientLimiter struct {
+	rate  float64
+	burst int
+
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when tokens was last updated
+}
+
+func newClientLimiter(rate float64, burst int) *clientLimiter {
+	return &clientLimiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the client's bucket at time now and reports
+// whether there was one. If there wasn't, it also returns how long until
+// the next token.
+func (l *clientLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	// Occasionally drop full buckets (clients idle long enough to have
+	// refilled), which behave the same as new ones, to bound memory
+	refill := time.Duration(float64(l.burst) / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) >= refill {
+		for key, b := range l.buckets {
+			if now.Sub(b.last) >= refill {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[client] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(float64(l.burst), b.tokens+elapsed.Seconds()*l.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// limitClients wraps next to rate limit requests per client IP (see
+// clientIP), responding with 429 Too Many Requests and a Retry-After
+// header when a client's bucket is empty. Health checks aren't limited.
+func (s *Server) limitClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if healthPaths[r.URL.EscapedPath()] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := s.clientLimiter.allow(s.clientIP(r), s.now())
+		if !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			data := map[string]any{"message": "too many requests; slow down"}
+			s.jsonError(w, http.StatusTooManyRequests, ErrorRateLimited, data)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP address of the client that made the request:
+// the last address in X-Forwarded-For (the one the proxy in front of the
+// server saw) if the server trusts that header, otherwise the connection's
+// remote address.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.trustForwardedFor {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			hops := strings.Split(values[len(values)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// CORS response header values for allowed origins.
+const (
+	corsAllowMethods = "GET, POST, PUT, DELETE, OPTIONS"
+	corsAllowHeaders = "Accept, Authorization, Content-Type, If-Match, If-None-Match, X-API-Key"
+	corsMaxAge       = 10 * 60 // seconds a browser may cache a preflight
+
+	// corsExposeHeaders are the response headers, beyond the CORS-safelisted
+	// ones, that scripts may read: the URL of a created album, the ETag to
+	// send back in If-None-Match, and when to retry after a 429 or 503.
+	corsExposeHeaders = "ETag, Location, Retry-After, X-Total-Count, X-Truncated"
+)
+
+// corsAllowed reports whether the origin may make cross-origin requests,
+// per the origins set with WithCORS.
+func (s *Server) corsAllowed(origin string) bool {
+	for _, allowed := range s.corsOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// corsHeaders returns the list of header names with the request ID header
+// added, as browsers need to be allowed to send and read it.
+func (s *Server) corsHeaders(names string) string {
+	if s.requestIDHeader == "" {
+		return names
+	}
+	return names + ", " + s.requestIDHeader
+}
+
+// cors wraps next to add CORS headers to responses for requests from
+// allowed origins, and to answer CORS preflight requests (OPTIONS with an
+// Access-Control-Request-Method header) with 204 No Content before they
+// reach the router. The request's Origin is echoed back only if it's in the
+// allowlist, or "*" is sent if any origin is allowed.
+func (s *Server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		allowed := origin != "" && s.corsAllowed(origin)
+		if allowed {
+			if s.corsAllowed("*") {
+				header.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				header.Set("Access-Control-Allow-Origin", origin)
+			}
+		}
+
+		preflight := r.Method == "OPTIONS" && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight {
+			if allowed {
+				header.Set("Access-Control-Expose-Headers", s.corsHeaders(corsExposeHeaders))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+		if allowed {
+			header.Set("Access-Control-Allow-Methods", corsAllowMethods)
+			header.Set("Access-Control-Allow-Headers", s.corsHeaders(corsAllowHeaders))
+			header.Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// csvHeader is the header row of the CSV export of albums.
+var csvHeader = []string{"id", "title", "artist", "price"}
+
+// albumsFormats are the values allowed for the "format" query parameter of
+// GET /albums, which overrides the Accept header.
+var albumsFormats = []string{"json", "csv"}
+
+// csvOverride reports whether the request is for the album list with
+// "format=csv", which is served whatever the Accept header allows.
+func csvOverride(r *http.Request, path string) bool {
+	return path == "/albums" && r.URL.Query().Get("format") == "csv"
+}
+
+// wantsCSV reports whether the album list should be written as CSV: if the
+// "format" query parameter is "csv", or if it's absent and the client
+// accepts "text/csv".
+func wantsCSV(r *http.Request, format string) bool {
+	if format != "" {
+		return format == "csv"
+	}
+	return accepts(r, "text/csv")
+}
+
+// writeAlbumsCSV writes the albums selected by query as a CSV attachment,
+// with a header row and one row per album. Like streamAlbums, it writes
+// each album as the database's EachAlbum passes it, and isn't paginated.
+func (s *Server) writeAlbumsCSV(w http.ResponseWriter, r *http.Request, query AlbumQuery) {
+	writer := csv.NewWriter(w)
+	start := func() {
+		w.Header().Add("Vary", "Accept")
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="albums.csv"`)
+		w.WriteHeader(http.StatusOK)
+		writer.Write(csvHeader) // an error shows up in the next Write or Error
+	}
+	ok := s.eachAlbum(w, r, query, start, func(album Album) error {
+		return writer.Write([]string{csvText(album.ID), csvText(album.Title), csvText(album.Artist), formatDollars(album.Price)})
+	})
+	writer.Flush() // whatever was written, even if the list stopped short
+	if err := writer.Error(); ok && err != nil {
+		s.logger(r).Warn("error writing albums CSV", "error", err)
+	}
+}
+
+// csvText returns a text cell's value, prefixed with "'" if it starts with
+// a character that makes spreadsheets treat it as a formula, so album data
+// can't run formulas when the export is opened.
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// formatDollars formats a price in cents as dollars, like "7.95" (or
+// "0.00" for a free album).
+func formatDollars(cents int) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	c := strconv.Itoa(cents % 100)
+	if len(c) < 2 {
+		c = "0" + c
+	}
+	return sign + strconv.Itoa(cents/100) + "." + c
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestFormatDollars(t *testing.T) {
+	tests := []struct {
+		cents int
+		want  string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{99, "0.99"},
+		{795, "7.95"},
+		{2000, "20.00"},
+		{-150, "-1.50"},
+	}
+	for _, test := range tests {
+		if got := formatDollars(test.cents); got != test.want {
+			t.Errorf("formatDollars(%d) = %q, want %q", test.cents, got, test.want)
+		}
+	}
+}
+
+func TestCSVText(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"Blue Train", "Blue Train"},
+		{"", ""},
+		{"=1+2", "'=1+2"},
+		{"+1", "'+1"},
+		{"-1", "'-1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"a=b", "a=b"},
+	}
+	for _, test := range tests {
+		if got := csvText(test.value); got != test.want {
+			t.Errorf("csvText(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
@@ -1,22 +1,92 @@
 package main
 
 import (
+	"context"
 	"sort"
 	"sync"
 )
 
 // Database is the interface used by the server to load and store albums.
+// Every method takes a context, and should give up and return the
+// context's error if it's canceled or times out.
 type Database interface {
 	// GetAlbums returns a copy of all albums, sorted by ID.
-	GetAlbums() ([]Album, error)
+	GetAlbums(ctx context.Context) ([]Album, error)
+
+	// GetAlbumsPage returns up to limit albums sorted by ID, skipping the
+	// first offset, along with the total number of albums.
+	GetAlbumsPage(ctx context.Context, offset, limit int) (albums []Album, total int, err error)
+
+	// GetAlbumsFiltered returns a copy of the albums that match filter,
+	// sorted by ID.
+	GetAlbumsFiltered(ctx context.Context, filter AlbumFilter) ([]Album, error)
+
+	// CountAlbums returns the number of albums that match filter.
+	CountAlbums(ctx context.Context, filter AlbumFilter) (int, error)
+
+	// EachAlbum calls fn with each album selected by query, in its order.
+	// fn may be slow (writing to a client, say), so implementations must
+	// not hold locks or connections that other operations need while it
+	// runs. If fn returns an error, EachAlbum stops and returns it. fn must
+	// not use the database.
+	EachAlbum(ctx context.Context, query AlbumQuery, fn func(Album) error) error
+
+	// GetAlbumsByArtist returns a copy of the albums whose normalized artist
+	// (see ArtistNormalization) is exactly artist, sorted by ID. It returns
+	// an empty slice if there are none.
+	GetAlbumsByArtist(ctx context.Context, artist string) ([]Album, error)
 
 	// GetAlbumByID returns a single album by ID, or ErrDoesNotExist if
 	// an album with that ID does not exist.
-	GetAlbumByID(id string) (Album, error)
+	GetAlbumByID(ctx context.Context, id string) (Album, error)
 
 	// AddAlbum adds a single album, or ErrAlreadyExists if an album with
-	// the given ID already exists.
-	AddAlbum(album Album) error
+	// the given ID already exists. The check and insert must be atomic: of
+	// any number of concurrent adds with the same ID, exactly one succeeds.
+	// SQL backends should rely on a unique constraint on the ID rather than
+	// a separate lookup before inserting. The album is stored with version
+	// 1, whatever its Version field.
+	AddAlbum(ctx context.Context, album Album) error
+
+	// UpdateAlbum replaces the stored album with the same ID if its version
+	// is still the given one, storing it with the next version and the
+	// stored album's CreatedAt. It returns
+	// ErrDoesNotExist if an album with that ID does not exist, or
+	// ErrVersionConflict if it has a different version. The check and
+	// update must be atomic.
+	UpdateAlbum(ctx context.Context, album Album, version int) error
+
+	// DeleteAlbum deletes a single album and its tracks by ID, or returns
+	// ErrDoesNotExist if an album with that ID does not exist.
+	DeleteAlbum(ctx context.Context, id string) error
+
+	// GetTracks returns a copy of the tracks on the given album, sorted by
+	// position, or ErrDoesNotExist if the album does not exist.
+	GetTracks(ctx context.Context, albumID string) ([]Track, error)
+
+	// AddTrack adds a track to the end of the given album and returns the
+	// stored track with its Position set. It returns ErrDoesNotExist if the
+	// album does not exist, ErrAlreadyExists if the album already has a
+	// track with the given ID, or ErrTooManyTracks if maxTracks is positive
+	// and the album already has that many tracks. The check and the add
+	// must be atomic, so concurrent adds can't exceed the limit.
+	AddTrack(ctx context.Context, albumID string, track Track, maxTracks int) (Track, error)
+
+	// ReorderTracks sets the positions of an album's tracks atomically to
+	// the order of trackIDs. It returns ErrDoesNotExist if the album does
+	// not exist, or ErrTrackMismatch if trackIDs is not exactly the set of
+	// the album's track IDs.
+	ReorderTracks(ctx context.Context, albumID string, trackIDs []string) error
+
+	// Ping checks that the database is reachable, returning an error if
+	// it isn't.
+	Ping(ctx context.Context) error
+
+	// WithTx calls fn with a Database whose operations all happen in one
+	// transaction: if fn returns nil they are committed together, and if it
+	// returns an error none of them take effect and WithTx returns that
+	// error. fn must only use the Database it is given, not the outer one.
+	WithTx(ctx context.Context, fn func(tx Database) error) error
 }
 
 // MemoryDatabase is a Database implementation that uses a simple
@@ -24,14 +94,21 @@ type Database interface {
 type MemoryDatabase struct {
 	lock   sync.RWMutex
 	albums map[string]Album
+	tracks map[string][]Track // keyed by album ID, in position order
 }
 
 // NewMemoryDatabase creates a new in-memory database.
 func NewMemoryDatabase() *MemoryDatabase {
-	return &MemoryDatabase{albums: make(map[string]Album)}
+	return &MemoryDatabase{
+		albums: make(map[string]Album),
+		tracks: make(map[string][]Track),
+	}
 }
 
-func (d *MemoryDatabase) GetAlbums() ([]Album, error) {
+func (d *MemoryDatabase) GetAlbums(ctx context.Context) ([]Album, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	d.lock.RLock()
 	defer d.lock.RUnlock()
 
@@ -48,7 +125,116 @@ func (d *MemoryDatabase) GetAlbums() ([]Album, error) {
 	return albums, nil
 }
 
-func (d *MemoryDatabase) GetAlbumByID(id string) (Album, error) {
+func (d *MemoryDatabase) GetAlbumsPage(ctx context.Context, offset, limit int) ([]Album, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	// Sort just the IDs, and only copy the albums on the requested page
+	ids := make([]string, 0, len(d.albums))
+	for id := range d.albums {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	total := len(ids)
+	start := offset
+	if start > total {
+		start = total
+	}
+	end := start + limit
+	if end > total {
+		end = total
+	}
+	albums := make([]Album, 0, end-start)
+	for _, id := range ids[start:end] {
+		albums = append(albums, d.albums[id])
+	}
+	return albums, total, nil
+}
+
+func (d *MemoryDatabase) GetAlbumsFiltered(ctx context.Context, filter AlbumFilter) ([]Album, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	albums := []Album{}
+	for _, album := range d.albums {
+		if filter.Matches(album) {
+			albums = append(albums, album)
+		}
+	}
+	sort.Slice(albums, func(i, j int) bool {
+		return albums[i].ID < albums[j].ID
+	})
+	return albums, nil
+}
+
+func (d *MemoryDatabase) CountAlbums(ctx context.Context, filter AlbumFilter) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	n := 0
+	for _, album := range d.albums {
+		if filter.Matches(album) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// EachAlbum copies the selected albums before calling fn, so a slow fn
+// (like one writing to a client) doesn't hold the lock.
+func (d *MemoryDatabase) EachAlbum(ctx context.Context, query AlbumQuery, fn func(Album) error) error {
+	albums, err := d.GetAlbumsFiltered(ctx, query.Filter)
+	if err != nil {
+		return err
+	}
+	sortAlbums(albums, query.Sort, query.Desc)
+	if query.Limit > 0 && len(albums) > query.Limit {
+		albums = albums[:query.Limit]
+	}
+	for _, album := range albums {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(album); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *MemoryDatabase) GetAlbumsByArtist(ctx context.Context, artist string) ([]Album, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	albums := []Album{}
+	for _, album := range d.albums {
+		if album.artistKey() == artist {
+			albums = append(albums, album)
+		}
+	}
+	sort.Slice(albums, func(i, j int) bool {
+		return albums[i].ID < albums[j].ID
+	})
+	return albums, nil
+}
+
+func (d *MemoryDatabase) GetAlbumByID(ctx context.Context, id string) (Album, error) {
+	if err := ctx.Err(); err != nil {
+		return Album{}, err
+	}
 	d.lock.RLock()
 	defer d.lock.RUnlock()
 
@@ -59,13 +245,163 @@ func (d *MemoryDatabase) GetAlbumByID(id string) (Album, error) {
 	return album, nil
 }
 
-func (d *MemoryDatabase) AddAlbum(album Album) error {
+func (d *MemoryDatabase) AddAlbum(ctx context.Context, album Album) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Holding the write lock across the check and insert makes them atomic
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
 	if _, ok := d.albums[album.ID]; ok {
 		return ErrAlreadyExists
 	}
+	album.Version = 1
+	d.albums[album.ID] = album
+	return nil
+}
+
+func (d *MemoryDatabase) UpdateAlbum(ctx context.Context, album Album, version int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	current, ok := d.albums[album.ID]
+	if !ok {
+		return ErrDoesNotExist
+	}
+	if current.Version != version {
+		return ErrVersionConflict
+	}
+	album.Version = version + 1
+	album.CreatedAt = current.CreatedAt
 	d.albums[album.ID] = album
 	return nil
 }
+
+func (d *MemoryDatabase) DeleteAlbum(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.albums[id]; !ok {
+		return ErrDoesNotExist
+	}
+	delete(d.albums, id)
+	delete(d.tracks, id)
+	return nil
+}
+
+func (d *MemoryDatabase) GetTracks(ctx context.Context, albumID string) ([]Track, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	if _, ok := d.albums[albumID]; !ok {
+		return nil, ErrDoesNotExist
+	}
+	tracks := make([]Track, len(d.tracks[albumID]))
+	copy(tracks, d.tracks[albumID])
+	return tracks, nil
+}
+
+func (d *MemoryDatabase) AddTrack(ctx context.Context, albumID string, track Track, maxTracks int) (Track, error) {
+	if err := ctx.Err(); err != nil {
+		return Track{}, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.albums[albumID]; !ok {
+		return Track{}, ErrDoesNotExist
+	}
+	if maxTracks > 0 && len(d.tracks[albumID]) >= maxTracks {
+		return Track{}, ErrTooManyTracks
+	}
+	for _, t := range d.tracks[albumID] {
+		if t.ID == track.ID {
+			return Track{}, ErrAlreadyExists
+		}
+	}
+	track.Position = len(d.tracks[albumID]) + 1
+	d.tracks[albumID] = append(d.tracks[albumID], track)
+	return track, nil
+}
+
+func (d *MemoryDatabase) ReorderTracks(ctx context.Context, albumID string, trackIDs []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.albums[albumID]; !ok {
+		return ErrDoesNotExist
+	}
+	current := d.tracks[albumID]
+	if len(trackIDs) != len(current) {
+		return ErrTrackMismatch
+	}
+	byID := make(map[string]Track, len(current))
+	for _, t := range current {
+		byID[t.ID] = t
+	}
+
+	// Build the new order in a separate slice so a mismatch part way
+	// through leaves the stored order untouched
+	tracks := make([]Track, 0, len(trackIDs))
+	for i, id := range trackIDs {
+		t, ok := byID[id]
+		if !ok {
+			return ErrTrackMismatch // unknown or duplicate ID
+		}
+		delete(byID, id)
+		t.Position = i + 1
+		tracks = append(tracks, t)
+	}
+	d.tracks[albumID] = tracks
+	return nil
+}
+
+// Ping always succeeds (unless ctx is done), as the data is in memory.
+func (d *MemoryDatabase) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// WithTx emulates a transaction by running fn against a staging copy of the
+// data while holding the write lock, and swapping the copy in if fn
+// succeeds. Other operations wait until the transaction finishes. Copying
+// makes this O(n) in the size of the catalog, which is fine for the small
+// data sets the in-memory database is meant for.
+func (d *MemoryDatabase) WithTx(ctx context.Context, fn func(tx Database) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	staging := &MemoryDatabase{
+		albums: make(map[string]Album, len(d.albums)),
+		tracks: make(map[string][]Track, len(d.tracks)),
+	}
+	for id, album := range d.albums {
+		staging.albums[id] = album
+	}
+	for id, tracks := range d.tracks {
+		staging.tracks[id] = append([]Track(nil), tracks...)
+	}
+
+	err := fn(staging)
+	if err != nil {
+		return err
+	}
+	d.albums = staging.albums
+	d.tracks = staging.tracks
+	return nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// flakyDatabase is a Database for testing decorators. It stores albums in
+// a MemoryDatabase, but GetAlbums, GetAlbumByID, EachAlbum and Ping fail
+// with err while failures is positive, counting down.
+type flakyDatabase struct {
+	*MemoryDatabase
+	err      error
+	failures atomic.Int32 // calls left to fail
+	calls    atomic.Int32 // calls to the failing methods
+
+	// If block isn't nil, GetAlbums sends on entered and then waits for
+	// block to be closed before returning.
+	entered chan struct{}
+	block   chan struct{}
+}
+
+// newFlakyDatabase returns a flakyDatabase that stores albums in db and
+// whose next failures calls fail with err.
+func newFlakyDatabase(db *MemoryDatabase, failures int, err error) *flakyDatabase {
+	d := &flakyDatabase{MemoryDatabase: db, err: err}
+	d.failures.Store(int32(failures))
+	return d
+}
+
+// fail counts a call and returns the error it should fail with, if any.
+func (d *flakyDatabase) fail() error {
+	d.calls.Add(1)
+	if d.failures.Add(-1) >= 0 {
+		return d.err
+	}
+	return nil
+}
+
+func (d *flakyDatabase) GetAlbums(ctx context.Context) ([]Album, error) {
+	err := d.fail()
+	if d.block != nil {
+		d.entered <- struct{}{}
+		<-d.block
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.MemoryDatabase.GetAlbums(ctx)
+}
+
+func (d *flakyDatabase) GetAlbumByID(ctx context.Context, id string) (Album, error) {
+	if err := d.fail(); err != nil {
+		return Album{}, err
+	}
+	return d.MemoryDatabase.GetAlbumByID(ctx, id)
+}
+
+func (d *flakyDatabase) EachAlbum(ctx context.Context, query AlbumQuery, fn func(Album) error) error {
+	if err := d.fail(); err != nil {
+		return err
+	}
+	return d.MemoryDatabase.EachAlbum(ctx, query, fn)
+}
+
+func (d *flakyDatabase) Ping(ctx context.Context) error {
+	if err := d.fail(); err != nil {
+		return err
+	}
+	return d.MemoryDatabase.Ping(ctx)
+}
+
+// testDatabases returns an empty database of each implementation, by name.
+func testDatabases(t *testing.T) map[string]Database {
+	t.Helper()
+	sqliteDB, err := NewSQLiteDatabase(filepath.Join(t.TempDir(), "albums.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqliteDB.Close() })
+	return map[string]Database{"memory": NewMemoryDatabase(), "sqlite": sqliteDB}
+}
+
+func TestConcurrentAddSameID(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			const n = 50
+			errs := make(chan error, n)
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					album := Album{ID: "same", Title: fmt.Sprint("Title ", i), Artist: "A", ArtistKey: "A", Price: i}
+					errs <- db.AddAlbum(context.Background(), album)
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+
+			added := 0
+			for err := range errs {
+				switch {
+				case err == nil:
+					added++
+				case !errors.Is(err, ErrAlreadyExists):
+					t.Errorf("got error %v, want %v", err, ErrAlreadyExists)
+				}
+			}
+			if added != 1 {
+				t.Errorf("%d of %d adds succeeded, want 1", added, n)
+			}
+		})
+	}
+}
+
+// TestConcurrentMemoryDatabase is meant for "go test -race": it adds,
+// updates and lists albums from many goroutines at once.
+func TestConcurrentMemoryDatabase(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			album := Album{ID: fmt.Sprint("c", i), Title: "T", Artist: "A", ArtistKey: "A", Price: i}
+			if err := db.AddAlbum(ctx, album); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			// Every update expects some version; all but one per version
+			// conflict
+			album := Album{ID: "a1", Title: fmt.Sprint("Update ", i), Artist: "Beethoven", ArtistKey: "Beethoven", Price: 795}
+			for version := 1; ; version++ {
+				err := db.UpdateAlbum(ctx, album, version)
+				if err == nil {
+					return
+				} else if !errors.Is(err, ErrVersionConflict) {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			if _, err := db.GetAlbums(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	albums, err := db.GetAlbums(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(albums) != 22 {
+		t.Errorf("got %d albums, want 22", len(albums))
+	}
+	album, err := db.GetAlbumByID(ctx, "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if album.Version != 21 {
+		t.Errorf("got version %d after 20 updates, want 21", album.Version)
+	}
+}
@@ -5,14 +5,44 @@ import "errors"
 var (
 	ErrDoesNotExist  = errors.New("does not exist")
 	ErrAlreadyExists = errors.New("already exists")
+	ErrTrackMismatch = errors.New("track IDs do not match the album's tracks")
+	ErrTooManyTracks = errors.New("album has the maximum number of tracks")
+
+	// ErrVersionConflict is returned when updating an album whose version
+	// isn't the expected one, because it was updated since the client read
+	// it.
+	ErrVersionConflict = errors.New("album version does not match")
+
+	// ErrTransient can be wrapped by Database implementations to mark an
+	// error as temporary (such as a dropped connection or a deadlock that
+	// rolled back): the operation did not take effect and may be retried.
+	ErrTransient = errors.New("transient database error")
+
+	// ErrRejected can be wrapped by a Hooks.OnBeforeWrite error to reject a
+	// write because of the request, as opposed to an internal failure.
+	ErrRejected = errors.New("write rejected")
+
+	// ErrUnavailable is returned when the database isn't being called at
+	// all, for example because a circuit breaker is open.
+	ErrUnavailable = errors.New("database unavailable")
 )
 
 const (
-	ErrorAlreadyExists    = "already-exists"
-	ErrorDatabase         = "database"
-	ErrorInternal         = "internal"
-	ErrorMalformedJSON    = "malformed-json"
-	ErrorMethodNotAllowed = "method-not-allowed"
-	ErrorNotFound         = "not-found"
-	ErrorValidation       = "validation"
+	ErrorAlreadyExists        = "already-exists"
+	ErrorBodyTooLarge         = "body-too-large"
+	ErrorDatabase             = "database"
+	ErrorEmptyBody            = "empty-body"
+	ErrorForbidden            = "forbidden"
+	ErrorInternal             = "internal"
+	ErrorMalformedJSON        = "malformed-json"
+	ErrorMethodNotAllowed     = "method-not-allowed"
+	ErrorNotAcceptable        = "not-acceptable"
+	ErrorNotFound             = "not-found"
+	ErrorRateLimited          = "rate-limited"
+	ErrorRejected             = "rejected"
+	ErrorUnauthorized         = "unauthorized"
+	ErrorUnavailable          = "unavailable"
+	ErrorUnsupportedMediaType = "unsupported-media-type"
+	ErrorValidation           = "validation"
+	ErrorVersionConflict      = "version-conflict"
 )
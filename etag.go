@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// albumETag returns a strong ETag for the album in the given response
+// format: its version and a hash of its JSON encoding (plus the format, as
+// each format is a different representation), like "3-9f86d081884c7d65".
+// The hash makes it change when an album is deleted and re-created with
+// the same ID, which starts the version again at 1. The whole tag can be
+// sent back in If-Match, where only the version is used.
+func albumETag(album Album, format responseFormat) string {
+	b, err := json.Marshal(album)
+	if err != nil {
+		return "" // can't happen for an Album
+	}
+	if format != formatJSON {
+		b = append(b, byte(format))
+	}
+	sum := sha256.Sum256(b)
+	return `"` + strconv.Itoa(album.Version) + "-" + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagVersion returns the album version in an ETag written by albumETag,
+// or in a bare version number, and whether tag was one of those.
+func etagVersion(tag string) (int, bool) {
+	tag = strings.TrimSpace(tag)
+	if len(tag) >= 2 && tag[0] == '"' && tag[len(tag)-1] == '"' {
+		tag = tag[1 : len(tag)-1]
+	}
+	tag, _, _ = strings.Cut(tag, "-")
+	n, err := strconv.Atoi(tag)
+	return n, err == nil && n >= 1
+}
+
+// etagMatches reports whether the request's If-None-Match header matches
+// etag, using the weak comparison RFC 9110 specifies for If-None-Match.
+func etagMatches(r *http.Request, etag string) bool {
+	for _, value := range r.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// albumFieldType is the type of an album field's values, which determines
+// how they're compared.
+type albumFieldType int
+
+const (
+	fieldString albumFieldType = iota // compared case-insensitively, unless Exact
+	fieldInt
+)
+
+// albumField describes an Album field that clients may sort or filter by.
+type albumField struct {
+	Name       string // the query parameter value or name, as in the JSON
+	Type       albumFieldType
+	Sortable   bool // valid as ?sort=<name>
+	Filterable bool // valid as ?<name>=<value>
+	Exact      bool // a fieldString compared byte for byte, not ignoring case
+
+	str    func(Album) string // accessor for fieldString fields
+	number func(Album) int    // accessor for fieldInt fields
+
+	// copy sets the field on dst to its value in src.
+	copy func(dst *Album, src Album)
+
+	// filter sets the field's criterion on an AlbumFilter, for filterable
+	// fields.
+	filter func(f *AlbumFilter, value string)
+}
+
+// albumFields is the registry of fields that the list endpoints may sort
+// and filter by, and that update permissions (see FieldPermissions) apply
+// to. Adding a field here (along with support in AlbumFilter if
+// it's filterable) enables it everywhere; any other field is rejected.
+var albumFields = []albumField{
+	{
+		Name:     "id",
+		Type:     fieldString,
+		Sortable: true,
+		Exact:    true, // sorts like the default (ID) order
+		str:      func(a Album) string { return a.ID },
+		copy:     func(dst *Album, src Album) { dst.ID = src.ID },
+	},
+	{
+		Name:       "title",
+		Type:       fieldString,
+		Sortable:   true,
+		Filterable: true,
+		str:        func(a Album) string { return a.Title },
+		copy:       func(dst *Album, src Album) { dst.Title = src.Title },
+		filter:     func(f *AlbumFilter, value string) { f.Title = value },
+	},
+	{
+		Name:       "artist",
+		Type:       fieldString,
+		Sortable:   true,
+		Filterable: true,
+		str:        func(a Album) string { return a.Artist },
+		copy:       func(dst *Album, src Album) { dst.Artist, dst.ArtistKey = src.Artist, src.ArtistKey },
+		filter:     func(f *AlbumFilter, value string) { f.Artist = value },
+	},
+	{
+		Name:     "price",
+		Type:     fieldInt,
+		Sortable: true,
+		number:   func(a Album) int { return a.Price },
+		copy:     func(dst *Album, src Album) { dst.Price = src.Price },
+	},
+}
+
+// lookupAlbumField returns the registered field with the given name.
+func lookupAlbumField(name string) (albumField, bool) {
+	for _, field := range albumFields {
+		if field.Name == name {
+			return field, true
+		}
+	}
+	return albumField{}, false
+}
+
+// sortableFields returns the names of the fields valid for ?sort=, in
+// registry order.
+func sortableFields() []string {
+	var names []string
+	for _, field := range albumFields {
+		if field.Sortable {
+			names = append(names, field.Name)
+		}
+	}
+	return names
+}
+
+// equal reports whether a and b have exactly the same value for the field
+// (unlike compareAlbums, strings that differ only in case aren't equal).
+func (f albumField) equal(a, b Album) bool {
+	if f.Type == fieldInt {
+		return f.number(a) == f.number(b)
+	}
+	return f.str(a) == f.str(b)
+}
+
+// sortOrders are the valid values of the "order" query parameter.
+var sortOrders = []string{"asc", "desc"}
+
+// parseAlbumFilter builds an AlbumFilter from the query parameters named
+// after filterable fields. Empty values don't filter.
+func parseAlbumFilter(query *queryParser) AlbumFilter {
+	var filter AlbumFilter
+	for _, field := range albumFields {
+		if !field.Filterable {
+			continue
+		}
+		if value := query.String(field.Name); value != "" {
+			field.filter(&filter, value)
+		}
+	}
+	return filter
+}
+
+// compareAlbums compares a and b by the named field, returning a negative
+// number if a sorts first, positive if b does, and zero if they're equal on
+// that field (or the field isn't registered). Strings are compared
+// case-insensitively, so "abba" and "ABBA" sort together, except for Exact
+// fields.
+func compareAlbums(a, b Album, name string) int {
+	field, ok := lookupAlbumField(name)
+	if !ok {
+		return 0
+	}
+	switch field.Type {
+	case fieldInt:
+		x, y := field.number(a), field.number(b)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		default:
+			return 0
+		}
+	default:
+		if field.Exact {
+			return strings.Compare(field.str(a), field.str(b))
+		}
+		return strings.Compare(strings.ToLower(field.str(a)), strings.ToLower(field.str(b)))
+	}
+}
+
+// sortAlbums sorts albums in place by the named field, descending if desc
+// is true. The sort is stable, so albums that are equal on the field keep
+// their existing (ID) order.
+func sortAlbums(albums []Album, name string, desc bool) {
+	sort.SliceStable(albums, func(i, j int) bool {
+		c := compareAlbums(albums[i], albums[j], name)
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// DefaultGzipMinSize is the default size in bytes below which responses
+// aren't compressed, as gzip's overhead outweighs the saving.
+const DefaultGzipMinSize = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// compressGzip wraps next to gzip response bodies of at least minSize
+// bytes for clients that accept it, unless the content type is already
+// compressed.
+func compressGzip(next http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == "HEAD" || !acceptsEncoding(r, "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, minSize: minSize}
+		defer gw.Close() // also runs if the handler returns early on an error
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipResponseWriter buffers the start of a response until it knows
+// whether the body is big enough to compress, then writes either through a
+// gzip.Writer or directly.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+
+	status  int    // status to write, or zero for 200
+	buf     []byte // body written before the decision
+	started bool   // whether the header has been written
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if !w.started && w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if w.started {
+		if w.gz != nil {
+			return w.gz.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.minSize {
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start writes the header and any buffered body, compressing the response
+// if compress is true and the content type is compressible.
+func (w *gzipResponseWriter) start(compress bool) error {
+	w.started = true
+	header := w.Header()
+	if compress && compressible(header.Get("Content-Type")) && header.Get("Content-Encoding") == "" {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzipWriters.Get().(*gzip.Writer)
+		w.gz.Reset(w.ResponseWriter)
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// Flush writes out what's buffered so far, so streaming responses still
+// reach the client promptly.
+func (w *gzipResponseWriter) Flush() {
+	if !w.started {
+		w.start(len(w.buf) >= w.minSize)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close finishes the response, writing a small body uncompressed and
+// completing the gzip stream if there is one.
+func (w *gzipResponseWriter) Close() error {
+	if !w.started {
+		w.start(false)
+	}
+	if w.gz == nil {
+		return nil
+	}
+	err := w.gz.Close()
+	w.gz.Reset(nil)
+	gzipWriters.Put(w.gz)
+	w.gz = nil
+	return err
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// compressible reports whether a response with the given content type is
+// worth compressing (it isn't already compressed, like images or zips).
+func compressible(contentType string) bool {
+	typ, _, _ := strings.Cut(contentType, ";")
+	typ = strings.TrimSpace(strings.ToLower(typ))
+	switch {
+	case typ == "":
+		return true
+	case strings.HasPrefix(typ, "image/"), strings.HasPrefix(typ, "audio/"), strings.HasPrefix(typ, "video/"):
+		return typ == "image/svg+xml"
+	case typ == "application/gzip", typ == "application/zip", typ == "application/zstd":
+		return false
+	default:
+		return true
+	}
+}
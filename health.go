@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+)
+
+// healthPaths are the health-check routes for load balancers and
+// orchestrators. They stay available in maintenance mode and successful
+// checks aren't logged, as they're polled constantly.
+var healthPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// getHealthz is the liveness check: it reports that the server is running
+// and able to handle requests, without touching the database.
+func (s *Server) getHealthz(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// getReadyz is the readiness check: it reports whether the server can
+// serve traffic, which requires the database to be reachable.
+func (s *Server) getReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := s.db.Ping(r.Context()); err != nil {
+		s.logger(r).Error("readiness check failed", "error", err)
+		data := map[string]any{
+			"message": "database is not reachable",
+			"error":   err.Error(),
+		}
+		s.jsonError(w, http.StatusServiceUnavailable, ErrorUnavailable, data)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, map[string]any{"status": "ready"})
+}
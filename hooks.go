@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// WriteAction identifies the kind of album write passed to Hooks.
+type WriteAction string
+
+const (
+	ActionAdd    WriteAction = "add"
+	ActionUpdate WriteAction = "update"
+	ActionDelete WriteAction = "delete"
+)
+
+// Hooks lets an application run its own logic (cache warming, syncing to
+// another system, metrics and so on) around album writes. For deletes,
+// only the album's ID is set.
+type Hooks interface {
+	// OnBeforeWrite is called after the request has been validated but
+	// before the database is written. Returning an error aborts the write:
+	// an error wrapping ErrRejected gets a 400 response with the error's
+	// message, and any other error a 500.
+	OnBeforeWrite(ctx context.Context, action WriteAction, album Album) error
+
+	// OnAfterWrite is called after a successful write, before the response
+	// is sent.
+	OnAfterWrite(ctx context.Context, action WriteAction, album Album)
+}
+
+// NoopHooks is a Hooks that does nothing; it's the server's default.
+type NoopHooks struct{}
+
+func (NoopHooks) OnBeforeWrite(ctx context.Context, action WriteAction, album Album) error {
+	return nil
+}
+
+func (NoopHooks) OnAfterWrite(ctx context.Context, action WriteAction, album Album) {}
+
+// beforeWrite calls the OnBeforeWrite hook, writing an error response and
+// returning false if it aborts the write.
+func (s *Server) beforeWrite(w http.ResponseWriter, r *http.Request, action WriteAction, album Album) bool {
+	err := s.hooks.OnBeforeWrite(r.Context(), action, album)
+	if errors.Is(err, ErrRejected) {
+		s.jsonError(w, http.StatusBadRequest, ErrorRejected, map[string]any{"message": err.Error()})
+		return false
+	} else if err != nil {
+		s.logger(r).Error("error in write hook", "action", action, "id", album.ID, "error", err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorInternal, nil)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"net/url"
+)
+
+// idEncoding is lowercase base32 without padding, so generated IDs are
+// URL-safe and easy to read out.
+var idEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// newAlbumID returns a random 128-bit album ID, as 26 base32 characters.
+// It's the default for WithIDGenerator.
+func newAlbumID() string {
+	return randomID(16)
+}
+
+// randomID returns n random bytes encoded with idEncoding.
+func randomID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("reading random bytes: " + err.Error()) // never fails on supported platforms
+	}
+	return idEncoding.EncodeToString(b)
+}
+
+// albumLocation returns the URL path of the album with the given ID, for
+// the Location header of a created album.
+func albumLocation(id string) string {
+	return "/albums/" + url.PathEscape(id)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// connLimitListener is a net.Listener that limits the number of
+// simultaneous connections from each client IP address. Connections beyond
+// the limit are closed as soon as they're accepted.
+type connLimitListener struct {
+	net.Listener
+	limit int
+
+	lock   sync.Mutex
+	counts map[string]int // open connections per IP
+}
+
+// limitConnsPerIP wraps l so that each client IP may have at most limit
+// connections open at once.
+func limitConnsPerIP(l net.Listener, limit int) net.Listener {
+	return &connLimitListener{Listener: l, limit: limit, counts: make(map[string]int)}
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+		if !l.acquire(ip) {
+			conn.Close()
+			continue
+		}
+		return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+	}
+}
+
+// acquire counts a new connection from ip, reporting false (and not
+// counting it) if ip is already at the limit.
+func (l *connLimitListener) acquire(ip string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.counts[ip] >= l.limit {
+		return false
+	}
+	l.counts[ip]++
+	return true
+}
+
+func (l *connLimitListener) release(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.counts[ip]--
+	if l.counts[ip] <= 0 {
+		delete(l.counts, ip)
+	}
+}
+
+// limitedConn is a connection that releases its slot in the per-IP count
+// when closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
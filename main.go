@@ -1,26 +1,276 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 )
 
 func main() {
 	// Allow user to specify listen port on command line
 	var port int
+	var slash string
+	var slowQuery time.Duration
+	var maxConnsPerIP int
+	var adminAPI bool
+	var startInMaintenance bool
+	var artistNormalize string
+	var serverHeader string
+	var requestIDHeader string
+	var compactJSON bool
+	var enableMetrics bool
+	var logFormat string
+	var dbKind string
+	var sqlitePath string
+	var sqliteReplicas string
+	var replicaSticky time.Duration
+	var dbRetries int
+	var dbRetryDelay, dbRetryMaxDelay time.Duration
+	var breakerThreshold int
+	var breakerCooldown time.Duration
+	var corsOrigins string
+	var rateLimit float64
+	var rateBurst int
+	var trustForwardedFor bool
+	var tlsCert, tlsKey, tlsMinVersion string
 	flag.IntVar(&port, "port", 8080, "port to listen on")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file, to serve HTTPS (with -tls-key)")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS private key file, to serve HTTPS (with -tls-cert)")
+	flag.StringVar(&tlsMinVersion, "tls-min-version", "1.2", "minimum TLS version with -tls-cert: 1.2 or 1.3")
+	flag.StringVar(&slash, "slash", "strict", "trailing slash handling: strict, redirect, or rewrite")
+	flag.DurationVar(&slowQuery, "slow-query", 0, "log database operations slower than this (0 to disable)")
+	flag.IntVar(&maxConnsPerIP, "max-conns-per-ip", 0, "maximum simultaneous connections per client IP (0 for no limit)")
+	flag.BoolVar(&adminAPI, "admin", false, "enable the /admin/ routes (they need an API key if ALBUMS_API_KEYS is set, and are open otherwise)")
+	flag.BoolVar(&startInMaintenance, "maintenance", false, "start in maintenance mode")
+	flag.StringVar(&artistNormalize, "artist-normalize", "", "artist normalization steps beyond trimming: comma-separated collapse, fold, article")
+	flag.StringVar(&serverHeader, "server-header", "", "value of the Server response header (none if empty)")
+	flag.BoolVar(&enableMetrics, "metrics", false, "serve Prometheus metrics at /metrics (readable without an API key)")
+	flag.BoolVar(&compactJSON, "compact-json", true, "write JSON without indentation (use -compact-json=false when developing)")
+	flag.StringVar(&requestIDHeader, "request-id-header", DefaultRequestIDHeader, "header for request IDs (none if empty)")
+	flag.StringVar(&logFormat, "log-format", "text", "log output format: text or json")
+	flag.StringVar(&dbKind, "db", "memory", "database: memory (with sample albums) or sqlite")
+	flag.StringVar(&sqlitePath, "sqlite-path", "albums.db", "SQLite database file, with -db=sqlite")
+	flag.StringVar(&sqliteReplicas, "sqlite-replicas", "", "comma-separated SQLite read replica files, kept up to date externally, with -db=sqlite")
+	flag.DurationVar(&replicaSticky, "replica-sticky", time.Second, "send reads to the primary for this long after a write, with -sqlite-replicas")
+	flag.IntVar(&dbRetries, "db-retries", 0, "times to retry database operations that fail with a transient error")
+	flag.DurationVar(&dbRetryDelay, "db-retry-delay", 50*time.Millisecond, "maximum wait before the first retry, doubling for each one after")
+	flag.DurationVar(&dbRetryMaxDelay, "db-retry-max-delay", time.Second, "maximum wait before any retry")
+	flag.IntVar(&breakerThreshold, "breaker-threshold", 0, "consecutive database failures that open the circuit breaker (0 for no breaker)")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second, "how long the circuit breaker stays open before trying the database again")
+	flag.StringVar(&corsOrigins, "cors-origins", "", "comma-separated origins allowed to make CORS requests, or * for any")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "maximum requests per second per client IP (0 for no limit)")
+	flag.IntVar(&rateBurst, "rate-burst", 20, "maximum burst of requests per client IP, with -rate-limit")
+	flag.BoolVar(&trustForwardedFor, "trust-forwarded-for", false, "take client IPs from X-Forwarded-For (only behind a proxy)")
 	flag.Parse()
 
-	// Create in-memory database and add a couple of test albums
-	db := NewMemoryDatabase()
-	db.AddAlbum(Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795})
-	db.AddAlbum(Album{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000})
+	// Log structured messages to stderr, as key=value text or JSON objects
+	var handler slog.Handler
+	switch logFormat {
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, nil)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, nil)
+	default:
+		log.Fatalf("invalid -log-format value %q", logFormat)
+	}
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
+
+	slashModes := map[string]SlashMode{
+		"strict":   SlashStrict,
+		"redirect": SlashRedirect,
+		"rewrite":  SlashRewrite,
+	}
+	slashMode, ok := slashModes[slash]
+	if !ok {
+		log.Fatalf("invalid -slash value %q", slash)
+	}
+
+	artistNorm, ok := parseArtistNormalization(artistNormalize)
+	if !ok {
+		log.Fatalf("invalid -artist-normalize value %q", artistNormalize)
+	}
+
+	// Open the database: either SQLite, or in-memory with a couple of test
+	// albums
+	var database Database
+	switch dbKind {
+	case "memory":
+		db := NewMemoryDatabase()
+		for _, album := range []Album{
+			{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795},
+			{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000},
+		} {
+			album.ArtistKey = artistNorm.Normalize(album.Artist)
+			album.CreatedAt = time.Now().UTC()
+			album.UpdatedAt = album.CreatedAt
+			db.AddAlbum(context.Background(), album)
+		}
+		database = db
+	case "sqlite":
+		db, err := NewSQLiteDatabase(sqlitePath)
+		if err != nil {
+			log.Fatalf("error opening SQLite database: %v", err)
+		}
+		defer db.Close()
+		database = db
+	default:
+		log.Fatalf("invalid -db value %q", dbKind)
+	}
+
+	// Spread reads across read replicas, if any
+	if sqliteReplicas != "" {
+		if dbKind != "sqlite" {
+			log.Fatal("-sqlite-replicas requires -db=sqlite")
+		}
+		var replicas []Database
+		for _, path := range strings.Split(sqliteReplicas, ",") {
+			replica, err := NewSQLiteDatabase(path)
+			if err != nil {
+				log.Fatalf("error opening SQLite replica %s: %v", path, err)
+			}
+			defer replica.Close()
+			replicas = append(replicas, replica)
+		}
+		database = NewReplicatedDatabase(database, replicas, replicaSticky)
+	}
+	if dbRetries > 0 {
+		database = NewRetryDatabase(database, dbRetries+1, dbRetryDelay, dbRetryMaxDelay)
+	}
+	// Fail fast while the database is down; outside the retries, so a call
+	// that needed retrying counts once
+	var breaker *BreakerDatabase
+	if breakerThreshold > 0 {
+		breaker = NewBreakerDatabase(database, breakerThreshold, breakerCooldown)
+		database = breaker
+	}
+
+	// Create server and wire up database, logging slow operations if enabled
+	if slowQuery > 0 {
+		database = NewTimingDatabase(database, logger, slowQuery)
+	}
+	opts := []Option{
+		WithLogger(logger),
+		WithSlashMode(slashMode),
+		WithAdminAPI(adminAPI),
+		WithArtistNormalization(artistNorm),
+		WithClientRateLimit(rateLimit, rateBurst),
+		WithTrustForwardedFor(trustForwardedFor),
+		WithRequestIDHeader(requestIDHeader),
+		WithCompactJSON(compactJSON),
+	}
+	if enableMetrics {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(
+			collectors.NewGoCollector(),
+			collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		)
+		if breaker != nil {
+			registry.MustRegister(NewBreakerStateGauge(breaker))
+		}
+		opts = append(opts, WithMetrics(registry))
+	}
+	// API keys come from the environment rather than a flag, so they don't
+	// show up in the process list
+	if keys := os.Getenv("ALBUMS_API_KEYS"); keys != "" {
+		opts = append(opts, WithAPIKeys(strings.Split(keys, ",")...))
+	}
+	if corsOrigins != "" {
+		opts = append(opts, WithCORS(strings.Split(corsOrigins, ",")...))
+	}
+	if serverHeader != "" {
+		opts = append(opts, WithServerHeader(serverHeader))
+	}
+	server := NewServer(database, opts...)
+	if startInMaintenance {
+		server.SetMaintenance(true, "", 0)
+	}
 
-	// Create server and wire up database
-	server := NewServer(db, log.Default())
+	// Serve HTTPS if given a certificate and key, loading them up front so
+	// a bad file fails at startup
+	var tlsConfig *tls.Config
+	if (tlsCert == "") != (tlsKey == "") {
+		log.Fatal("-tls-cert and -tls-key must be given together")
+	}
+	if tlsCert != "" {
+		minVersion, ok := tlsVersions[tlsMinVersion]
+		if !ok {
+			log.Fatalf("invalid -tls-min-version value %q", tlsMinVersion)
+		}
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatalf("error loading TLS certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: minVersion}
+	}
 
-	log.Printf("listening on http://localhost:%d", port)
-	http.ListenAndServe(":"+strconv.Itoa(port), server)
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if maxConnsPerIP > 0 {
+		listener = limitConnsPerIP(listener, maxConnsPerIP)
+	}
+
+	srv := &http.Server{Handler: server.Handler(), TLSConfig: tlsConfig}
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			logger.Info("listening", "url", "https://localhost:"+strconv.Itoa(port))
+			serveErr <- srv.ServeTLS(listener, "", "") // certificate is in TLSConfig
+			return
+		}
+		logger.Info("listening", "url", "http://localhost:"+strconv.Itoa(port))
+		serveErr <- srv.Serve(listener)
+	}()
+
+	// Wait for SIGINT or SIGTERM, then let requests in progress finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process immediately
+
+	logger.Info("shutting down, waiting for requests to finish", "timeout", shutdownTimeout.String())
+	server.StartShutdown()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		logger.Warn("shutdown timed out, dropping remaining connections")
+	case err != nil:
+		logger.Error("error shutting down", "error", err)
+		os.Exit(1)
+	default:
+		logger.Info("shutdown complete")
+	}
 }
+
+// tlsVersions are the allowed -tls-min-version values. Versions before 1.2
+// are deprecated (RFC 8996).
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// shutdownTimeout is how long to wait for requests in progress to finish
+// when shutting down.
+const shutdownTimeout = 10 * time.Second
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maintenance describes the server's maintenance mode. While enabled, all
+// requests other than admin (and health check and metrics) routes get a
+// 503.
+type maintenance struct {
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"` // seconds
+}
+
+// defaultMaintenance is used for the message and Retry-After when they
+// aren't specified.
+var defaultMaintenance = maintenance{
+	Message:    "the service is down for maintenance; please try again later",
+	RetryAfter: 300,
+}
+
+// SetMaintenance turns maintenance mode on or off. An empty message or zero
+// retryAfter (in seconds) uses a default.
+func (s *Server) SetMaintenance(enabled bool, message string, retryAfter int) {
+	m := maintenance{Enabled: enabled}
+	if enabled {
+		m.Message = message
+		if m.Message == "" {
+			m.Message = defaultMaintenance.Message
+		}
+		m.RetryAfter = retryAfter
+		if m.RetryAfter <= 0 {
+			m.RetryAfter = defaultMaintenance.RetryAfter
+		}
+	}
+	old := s.maintenance.Swap(&m)
+	switch {
+	case enabled && (old == nil || !old.Enabled):
+		s.log.Info("entering maintenance mode", "message", m.Message)
+	case !enabled && old != nil && old.Enabled:
+		s.log.Info("leaving maintenance mode")
+	}
+}
+
+// inMaintenance writes a 503 and returns true if the server is in
+// maintenance mode and the request isn't for a route that stays available.
+func (s *Server) inMaintenance(w http.ResponseWriter, path string) bool {
+	m := s.maintenance.Load()
+	if m == nil || !m.Enabled || strings.HasPrefix(path, "/admin/") || healthPaths[path] || path == "/metrics" {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter))
+	s.jsonError(w, http.StatusServiceUnavailable, ErrorUnavailable, map[string]any{"message": m.Message})
+	return true
+}
+
+// getMaintenance writes the current maintenance mode settings.
+func (s *Server) getMaintenance(w http.ResponseWriter, r *http.Request) {
+	m := s.maintenance.Load()
+	if m == nil {
+		m = &maintenance{}
+	}
+	s.writeJSON(w, http.StatusOK, m)
+}
+
+// setMaintenance turns maintenance mode on or off from a JSON body like
+// {"enabled": true, "message": "...", "retry_after": 600}.
+func (s *Server) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	var m maintenance
+	if !s.readJSON(w, r, &m) {
+		return
+	}
+	s.SetMaintenance(m.Enabled, m.Message, m.RetryAfter)
+	s.getMaintenance(w, r)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics are the Prometheus metrics the Handler middleware records, and
+// the registry they're served from at /metrics (see WithMetrics).
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	handler  http.Handler
+}
+
+func newMetrics(registry *prometheus.Registry) *metrics {
+	m := &metrics{
+		registry: registry,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of HTTP requests handled, by method, route and status code.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time taken to handle HTTP requests, by method and route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		handler: promhttp.HandlerFor(registry, promhttp.HandlerOpts{}),
+	}
+	registry.MustRegister(m.requests, m.duration)
+	return m
+}
+
+// NewBreakerStateGauge returns a gauge of the breaker's state (see
+// BreakerState: 0 for closed, 1 for open and 2 for half-open), to register
+// with the registry given to WithMetrics.
+func NewBreakerStateGauge(breaker *BreakerDatabase) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "database_breaker_state",
+		Help: "State of the database circuit breaker: 0 closed, 1 open, 2 half-open.",
+	}, func() float64 {
+		return float64(breaker.State())
+	})
+}
+
+// instrument wraps next to record each request in the server's metrics,
+// labeled by route template (see routeTemplate) so that IDs in paths don't
+// create a new time series each.
+func (s *Server) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		method := r.Method
+		if !standardMethods[method] {
+			method = "OTHER"
+		}
+		route := routeTemplate(r.URL.EscapedPath())
+		s.metrics.requests.WithLabelValues(method, route, strconv.Itoa(rec.Status())).Inc()
+		s.metrics.duration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeTemplate returns the route that ServeHTTP matches the path to, with
+// parameters replaced by placeholders (like "/albums/:id"), or "other" for
+// paths that don't match any route. A trailing slash is ignored.
+func routeTemplate(path string) string {
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+	switch {
+	case reAlbumsID.MatchString(path) && path != "/albums/validate" && path != "/albums/schema":
+		return "/albums/:id"
+	case reAlbumsIDTracks.MatchString(path):
+		return "/albums/:id/tracks"
+	case reAlbumsIDTracksOrder.MatchString(path):
+		return "/albums/:id/tracks/order"
+	case reArtistsNameAlbums.MatchString(path):
+		return "/artists/:name/albums"
+	}
+	switch path {
+	case "/albums", "/albums/validate", "/albums/schema", "/admin/maintenance",
+		"/healthz", "/readyz", "/metrics", "/favicon.ico", "/robots.txt":
+		return path
+	}
+	return "other"
+}
+
+// getMetrics writes the server's metrics in the Prometheus text format.
+func (s *Server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	s.metrics.handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// Handler returns the server wrapped in middleware that rate limits
+// clients if configured (see WithClientRateLimit), checks API keys if
+// configured (see WithAPIKeys), recovers from panics in handlers (see
+// recoverPanics), gzips larger responses for
+// clients that accept it (see WithGzipMinSize), handles CORS if enabled
+// (see WithCORS), applies the Server header policy (see WithServerHeader),
+// logs each request's method, path, response status, response size and
+// duration once the request has been handled (except successful health
+// checks), records request metrics if enabled (see WithMetrics), traces
+// requests if enabled (see WithTracerProvider), and gives each request an
+// ID (see WithRequestIDHeader). Use the
+// Server itself as the handler to serve without this middleware.
+func (s *Server) Handler() http.Handler {
+	var h http.Handler = s
+	if len(s.apiKeys) > 0 {
+		h = s.requireAPIKey(h)
+	}
+	if s.clientLimiter != nil {
+		h = s.limitClients(h)
+	}
+	h = s.recoverPanics(h)
+	if s.gzipMinSize >= 0 {
+		h = compressGzip(h, s.gzipMinSize)
+	}
+	if len(s.corsOrigins) > 0 {
+		h = s.cors(h)
+	}
+	if s.serverHeader != nil {
+		h = setServerHeader(h, *s.serverHeader)
+	}
+	if s.metrics != nil {
+		h = s.instrument(h)
+	}
+	h = s.logRequests(h)
+	if s.tracerProvider != nil {
+		h = s.traceRequests(h)
+	}
+	if s.requestIDHeader != "" {
+		h = s.assignRequestID(h)
+	}
+	return h
+}
+
+// setServerHeader wraps next so that responses have the given Server
+// header, or none if value is empty, whatever next sets.
+func setServerHeader(next http.Handler, value string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&serverHeaderWriter{ResponseWriter: w, value: value}, r)
+	})
+}
+
+// serverHeaderWriter is an http.ResponseWriter that sets or removes the
+// Server header just before the response header is written.
+type serverHeaderWriter struct {
+	http.ResponseWriter
+	value   string
+	applied bool
+}
+
+func (w *serverHeaderWriter) apply() {
+	if w.applied {
+		return
+	}
+	w.applied = true
+	if w.value == "" {
+		w.Header().Del("Server")
+	} else {
+		w.Header().Set("Server", w.value)
+	}
+}
+
+func (w *serverHeaderWriter) WriteHeader(status int) {
+	w.apply()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *serverHeaderWriter) Write(b []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *serverHeaderWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.apply()
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (w *serverHeaderWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// recoverPanics wraps next so that a panic while handling a request is
+// logged with a stack trace and the client gets a 500 ErrorInternal
+// response, instead of the connection being dropped.
+//
+// If the handler had already started writing the response when it
+// panicked, the status can no longer be changed and the error is appended
+// to whatever was written, so the client may see a truncated or malformed
+// body.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v) // deliberate abort; let net/http handle it quietly
+			}
+			s.logger(r).Error("panic serving request", "panic", v, "stack", string(debug.Stack()))
+			s.jsonError(w, http.StatusInternalServerError, ErrorInternal, nil)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logRequests wraps next to log each request after it's been handled. It
+// also attaches a logger with the request's method, path and ID to the
+// request context, for handlers to log with (see Server.logger).
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		logger := s.requestLogger(r)
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, logger))
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if healthPaths[r.URL.EscapedPath()] && rec.Status() == http.StatusOK {
+			return
+		}
+		duration := float64(time.Since(start).Microseconds()) / 1000
+		logger.Info("request", "status", rec.Status(), "bytes", rec.bytes, "duration_ms", duration)
+	})
+}
+
+// loggerKey is the request context key for the request-scoped logger.
+type loggerKey struct{}
+
+// logger returns the logger for messages about the request, which includes
+// the request's method, path and ID.
+func (s *Server) logger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return s.requestLogger(r)
+}
+
+// requestLogger returns a new logger with the request's method, path and
+// ID (if it has one).
+func (s *Server) requestLogger(r *http.Request) *slog.Logger {
+	logger := s.log.With("method", r.Method, "path", r.URL.EscapedPath())
+	if id := RequestIDFromContext(r.Context()); id != "" {
+		logger = logger.With("request_id", id)
+	}
+	return logger
+}
+
+// statusRecorder is an http.ResponseWriter that records the status code and
+// number of body bytes written, passing everything through to the wrapped
+// ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int // zero until WriteHeader or Write is called
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK // as the wrapped ResponseWriter will do
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush forwards to the wrapped ResponseWriter if it supports flushing, so
+// streaming responses still work through the recorder.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Status returns the response status code, which is 200 if the handler
+// never called WriteHeader.
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
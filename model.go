@@ -1,9 +1,148 @@
 package main
 
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
 // Album represents data about a single album.
 type Album struct {
-	ID     string `json:"id"`
-	Title  string `json:"title"`
-	Artist string `json:"artist"`
-	Price  int    `json:"price,omitempty"` // use int cents instead of float64 for currency
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Artist    string    `json:"artist"`               // display name, as given by the client
+	ArtistKey string    `json:"artist_key,omitempty"` // normalized artist, set by the server
+	Price     int       `json:"price,omitempty"`      // use int cents instead of float64 for currency
+	Version   int       `json:"version,omitempty"`    // starts at 1, incremented by each update
+	CreatedAt time.Time `json:"created_at"`           // set by the server
+	UpdatedAt time.Time `json:"updated_at"`           // set by the server
+}
+
+// artistKey returns the album's normalized artist, falling back to the
+// display name for albums stored without one.
+func (a Album) artistKey() string {
+	if a.ArtistKey == "" {
+		return a.Artist
+	}
+	return a.ArtistKey
+}
+
+// ValidationRules holds the configurable limits used when validating input.
+type ValidationRules struct {
+	// MaxTextLength is the maximum number of characters (not bytes) allowed
+	// in text fields such as IDs, titles and artist names. Zero means no
+	// limit.
+	MaxTextLength int
+
+	// MaxTracks is the maximum number of tracks an album may have. Zero
+	// means no limit.
+	MaxTracks int
+
+	// PriceRequired makes price a required field when creating or replacing
+	// an album. If false, an omitted price means a price of zero (free).
+	PriceRequired bool
+}
+
+// Defaults for the corresponding ValidationRules fields.
+const (
+	DefaultMaxTextLength = 512
+	DefaultMaxTracks     = 100
+)
+
+// AlbumFilter holds optional criteria for selecting albums; an album must
+// match all the criteria that are set.
+type AlbumFilter struct {
+	Artist   string // case-insensitive substring of the normalized artist, if not empty
+	Title    string // case-insensitive substring of the title, if not empty
+	MinPrice *int   // minimum price in cents (inclusive), if not nil
+	MaxPrice *int   // maximum price in cents (inclusive), if not nil
+}
+
+// AlbumQuery selects albums for Database.EachAlbum.
+type AlbumQuery struct {
+	Filter AlbumFilter
+	Sort   string // a sortable field in albumFields; "" sorts by ID
+	Desc   bool   // sort descending; ties are always in ascending ID order
+	Limit  int    // maximum number of albums, or zero for no limit
+}
+
+// IsZero reports whether the filter has no criteria (matches everything).
+func (f AlbumFilter) IsZero() bool {
+	return f == AlbumFilter{}
+}
+
+// Matches reports whether album matches the filter.
+func (f AlbumFilter) Matches(album Album) bool {
+	if f.Artist != "" && !containsFold(album.artistKey(), f.Artist) {
+		return false
+	}
+	if f.Title != "" && !containsFold(album.Title, f.Title) {
+		return false
+	}
+	if f.MinPrice != nil && album.Price < *f.MinPrice {
+		return false
+	}
+	if f.MaxPrice != nil && album.Price > *f.MaxPrice {
+		return false
+	}
+	return true
+}
+
+// containsFold reports whether substr is within s, ignoring case.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// maxPrice is the exclusive upper limit of an album's price, in cents.
+const maxPrice = 100000
+
+// Validate checks the album's fields and returns a map of validation issues
+// keyed by JSON field name, or an empty map if the album is valid.
+func (a Album) Validate(rules ValidationRules) map[string]any {
+	issues := make(map[string]any)
+	rules.checkText(issues, "id", a.ID)
+	rules.checkText(issues, "title", a.Title)
+	rules.checkText(issues, "artist", a.Artist)
+	if a.Price < 0 || a.Price >= maxPrice {
+		issues["price"] = validationIssue{"out-of-range", "price must be between 0 and $1000"}
+	}
+	return issues
+}
+
+// Track represents a single track on an album.
+type Track struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Duration int    `json:"duration"` // length of the track in seconds
+	Position int    `json:"position"` // 1-based position on the album, set by the database
+}
+
+// Validate checks the track's fields and returns a map of validation issues
+// keyed by JSON field name, or an empty map if the track is valid.
+func (t Track) Validate(rules ValidationRules) map[string]any {
+	issues := make(map[string]any)
+	rules.checkText(issues, "id", t.ID)
+	rules.checkText(issues, "title", t.Title)
+	if t.Duration <= 0 {
+		issues["duration"] = validationIssue{"out-of-range", "duration must be a positive number of seconds"}
+	}
+	return issues
+}
+
+// validationIssue describes a problem with a single input field, returned
+// in the "data" field of an ErrorValidation response.
+type validationIssue struct {
+	Error   string `json:"error"`
+	Message string `json:"message,omitempty"`
+}
+
+// checkText adds an issue for field if value is empty or too long.
+func (r ValidationRules) checkText(issues map[string]any, field, value string) {
+	if value == "" {
+		issues[field] = validationIssue{"required", ""}
+	} else if r.MaxTextLength > 0 && utf8.RuneCountInString(value) > r.MaxTextLength {
+		message := fmt.Sprintf("%s must be at most %d characters", field, r.MaxTextLength)
+		issues[field] = validationIssue{"too-long", message}
+	}
 }
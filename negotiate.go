@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// responseFormat is an encoding the server can write album data in.
+type responseFormat int
+
+const (
+	formatJSON responseFormat = iota
+	formatMsgpack
+)
+
+// mediaTypeFormats maps the media types clients may list in an Accept
+// header to the response format used for them. Wildcards, NDJSON and CSV
+// (which only GET /albums writes, falling back to JSON elsewhere) map to
+// JSON.
+var mediaTypeFormats = map[string]responseFormat{
+	"application/json":      formatJSON,
+	"application/x-ndjson":  formatJSON,
+	"text/csv":              formatJSON,
+	"application/*":         formatJSON,
+	"*/*":                   formatJSON,
+	"application/msgpack":   formatMsgpack,
+	"application/x-msgpack": formatMsgpack,
+}
+
+// negotiateFormat picks the response format from the request's Accept
+// header, preferring the supported media type with the highest quality (the
+// first listed, on a tie). With no Accept header the format is JSON. It
+// returns false if the header only lists unsupported media types.
+func negotiateFormat(r *http.Request) (responseFormat, bool) {
+	values := r.Header.Values("Accept")
+	if len(values) == 0 {
+		return formatJSON, true
+	}
+	best, bestQ := formatJSON, 0.0
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			typ, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			format, ok := mediaTypeFormats[typ]
+			if !ok {
+				continue
+			}
+			q := 1.0
+			if s, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(s, 64); err != nil {
+					continue
+				}
+			}
+			if q > bestQ {
+				best, bestQ = format, q
+			}
+		}
+	}
+	return best, bestQ > 0
+}
+
+// negotiated reports whether the response to the request depends on its
+// Accept header, so that it gets 406 Not Acceptable if none of the album
+// formats are allowed. Health checks, metrics, robots.txt and favicon.ico
+// have a single format of their own, and "format=csv" overrides Accept.
+func negotiated(r *http.Request, path string) bool {
+	switch {
+	case healthPaths[path], path == "/metrics", path == "/robots.txt", path == "/favicon.ico":
+		return false
+	default:
+		return !csvOverride(r, path)
+	}
+}
+
+// notAcceptable writes a 406 response listing the supported media types.
+func (s *Server) notAcceptable(w http.ResponseWriter) {
+	data := map[string]any{
+		"message":   "the Accept header doesn't allow any supported media type",
+		"supported": []string{"application/json", "application/msgpack"},
+	}
+	s.jsonError(w, http.StatusNotAcceptable, ErrorNotAcceptable, data)
+}
+
+// isJSONContentType reports whether a request Content-Type header is JSON:
+// "application/json", optionally with a UTF-8 charset parameter.
+func isJSONContentType(contentType string) bool {
+	typ, params, err := mime.ParseMediaType(contentType)
+	if err != nil || typ != "application/json" {
+		return false
+	}
+	charset, ok := params["charset"]
+	return !ok || strings.EqualFold(charset, "utf-8")
+}
+
+// unsupportedMediaType writes a 415 response for a request body that
+// isn't JSON.
+func (s *Server) unsupportedMediaType(w http.ResponseWriter) {
+	data := map[string]any{
+		"message":   `the request body must be JSON, with Content-Type "application/json"`,
+		"supported": []string{"application/json"},
+	}
+	s.jsonError(w, http.StatusUnsupportedMediaType, ErrorUnsupportedMediaType, data)
+}
+
+// writeResponse writes v in the format negotiated from the request's
+// Accept header: MessagePack if the client prefers it, otherwise JSON (see
+// writeJSON).
+func (s *Server) writeResponse(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Add("Vary", "Accept")
+	if format, _ := negotiateFormat(r); format == formatMsgpack {
+		s.writeMsgpack(w, status, v)
+		return
+	}
+	s.writeJSON(w, status, v)
+}
+
+// writeMsgpack marshals v to MessagePack and writes it to the response,
+// using the same field names as the JSON encoding.
+func (s *Server) writeMsgpack(w http.ResponseWriter, status int, v any) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	err := encoder.Encode(v)
+	if err != nil {
+		s.log.Error("error marshaling MessagePack", "error", err)
+		s.jsonError(w, http.StatusInternalServerError, ErrorInternal, nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/msgpack")
+	w.WriteHeader(status)
+	_, err = w.Write(buf.Bytes())
+	if err != nil {
+		s.log.Error("error writing MessagePack", "error", err)
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option configures optional Server behavior; pass options to NewServer.
+type Option func(*Server)
+
+// WithLogger sets the logger for request logs and errors. The default is
+// slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Server) {
+		s.log = logger
+	}
+}
+
+// WithNow sets the function used to get the current time, such as for album
+// timestamps and rate limits, so tests can control the clock. The default
+// is time.Now.
+func WithNow(now func() time.Time) Option {
+	return func(s *Server) {
+		s.now = now
+	}
+}
+
+// WithNoContentOnEmpty makes GET /albums respond with 204 No Content when
+// the catalog is empty. By default it responds with 200 and a page with an
+// empty "albums" array. A filter or offset that matches nothing in a
+// non-empty catalog always gets the 200.
+func WithNoContentOnEmpty(enabled bool) Option {
+	return func(s *Server) {
+		s.noContentOnEmpty = enabled
+	}
+}
+
+// WithRobotsTxt sets the body served at /robots.txt. The default disallows
+// all crawling.
+func WithRobotsTxt(body string) Option {
+	return func(s *Server) {
+		s.robotsTxt = body
+	}
+}
+
+// SlashMode controls how the router treats a trailing slash on a request
+// path, such as "/albums/".
+type SlashMode int
+
+const (
+	// SlashStrict treats "/albums/" as a different (unknown) path to
+	// "/albums", so it gets a 404. This is the default.
+	SlashStrict SlashMode = iota
+
+	// SlashRedirect responds with a 308 Permanent Redirect to the path
+	// without the trailing slash, preserving the method and query string.
+	SlashRedirect
+
+	// SlashRewrite routes the request as if the trailing slash wasn't there.
+	SlashRewrite
+)
+
+// WithSlashMode sets how paths with a trailing slash are routed.
+func WithSlashMode(mode SlashMode) Option {
+	return func(s *Server) {
+		s.slashMode = mode
+	}
+}
+
+// WithMaxTextLength sets the maximum number of characters allowed in text
+// fields like album titles and artist names; zero removes the limit. The
+// default is DefaultMaxTextLength.
+func WithMaxTextLength(n int) Option {
+	return func(s *Server) {
+		s.rules.MaxTextLength = n
+	}
+}
+
+// WithMaxTracks sets the maximum number of tracks an album may have; zero
+// removes the limit. The default is DefaultMaxTracks.
+func WithMaxTracks(n int) Option {
+	return func(s *Server) {
+		s.rules.MaxTracks = n
+	}
+}
+
+// WithMaxListSize caps the number of albums returned by the unpaginated
+// (NDJSON and CSV) forms of GET /albums; zero removes the cap. The default
+// is DefaultMaxListSize.
+func WithMaxListSize(n int) Option {
+	return func(s *Server) {
+		s.maxListSize = n
+	}
+}
+
+// WithArtistNormalization sets how artist names are normalized into the
+// artist_key used by the ?artist= filter, /artists/:name/albums and the
+// per-artist rate limit. The default only trims whitespace.
+func WithArtistNormalization(n ArtistNormalization) Option {
+	return func(s *Server) {
+		s.artistNorm = n
+	}
+}
+
+// WithMaxBodyBytes sets the maximum size of a request body in bytes; larger
+// bodies are rejected with 413 Request Entity Too Large. Zero removes the
+// limit. The default is DefaultMaxBodyBytes.
+func WithMaxBodyBytes(n int64) Option {
+	return func(s *Server) {
+		s.maxBodyBytes = n
+	}
+}
+
+// WithHooks sets hooks to call around album writes. The default is
+// NoopHooks.
+func WithHooks(hooks Hooks) Option {
+	return func(s *Server) {
+		s.hooks = hooks
+	}
+}
+
+// WithRequestIDHeader sets the header the Handler middleware reads request
+// IDs from, and echoes them in, generating an ID for requests without a
+// valid one. An empty name disables request IDs. The default is
+// DefaultRequestIDHeader.
+func WithRequestIDHeader(name string) Option {
+	return func(s *Server) {
+		s.requestIDHeader = name
+	}
+}
+
+// WithMetrics makes the Handler middleware record Prometheus metrics for
+// each request (counts by method, route and status, and durations), and
+// serves them along with anything else in the registry at GET /metrics.
+// Each server needs its own registry, such as from prometheus.NewRegistry,
+// so tests don't share metrics through a global one. Like other GETs,
+// /metrics only needs an API key with WithAuthenticatedReads. Metrics are
+// off by default.
+func WithMetrics(registry *prometheus.Registry) Option {
+	return func(s *Server) {
+		s.metrics = nil
+		if registry != nil {
+			s.metrics = newMetrics(registry)
+		}
+	}
+}
+
+// WithTracerProvider enables OpenTelemetry tracing with spans from the
+// given provider: the Handler middleware records a server span for each
+// request (continuing any W3C trace context in the request headers), and
+// the server's Database is wrapped to record a child span for each
+// operation (see TracingDatabase). By default nothing is traced.
+func WithTracerProvider(provider trace.TracerProvider) Option {
+	return func(s *Server) {
+		s.tracerProvider = provider
+	}
+}
+
+// WithServerHeader makes the Handler middleware set the Server response
+// header to value, or remove it if value is empty (for example, to avoid
+// revealing the software in use). By default the header isn't touched, and
+// net/http doesn't send one.
+func WithServerHeader(value string) Option {
+	return func(s *Server) {
+		s.serverHeader = &value
+	}
+}
+
+// WithFieldPermissions restricts which fields an update may change. By
+// default, all fields may be changed.
+func WithFieldPermissions(perms FieldPermissions) Option {
+	return func(s *Server) {
+		s.fieldPerms = perms
+	}
+}
+
+// WithCORS enables CORS in the Handler middleware for requests from the
+// given origins (such as "https://app.example.com"), so browser apps on
+// those origins can call the API. The origin "*" allows any origin, which
+// is meant for development. By default CORS is disabled.
+func WithCORS(origins ...string) Option {
+	return func(s *Server) {
+		s.corsOrigins = origins
+	}
+}
+
+// WithGzipMinSize sets the size in bytes below which the Handler
+// middleware doesn't gzip responses; a negative size disables compression.
+// The default is DefaultGzipMinSize.
+func WithGzipMinSize(n int) Option {
+	return func(s *Server) {
+		s.gzipMinSize = n
+	}
+}
+
+// WithAPIKeys makes the Handler middleware require one of the given API
+// keys for writes (POST, PUT, DELETE and so on) and the /admin/ routes.
+// Clients send the key as "Authorization: Bearer <key>" or in an X-API-Key
+// header. By default no key is required.
+func WithAPIKeys(keys ...string) Option {
+	return func(s *Server) {
+		s.apiKeys = keys
+	}
+}
+
+// WithAuthenticatedReads sets whether GET requests also require an API key
+// when WithAPIKeys is used. By default reads are public.
+func WithAuthenticatedReads(enabled bool) Option {
+	return func(s *Server) {
+		s.authenticatedReads = enabled
+	}
+}
+
+// WithClientRateLimit makes the Handler middleware limit each client IP to
+// rate requests per second on average, with bursts of up to burst
+// requests, responding with 429 Too Many Requests beyond that. It's
+// disabled by default (or if rate or burst isn't positive).
+func WithClientRateLimit(rate float64, burst int) Option {
+	return func(s *Server) {
+		s.clientLimiter = nil
+		if rate > 0 && burst > 0 {
+			s.clientLimiter = newClientLimiter(rate, burst)
+		}
+	}
+}
+
+// WithTrustForwardedFor sets whether the client IP used for rate limiting
+// comes from the X-Forwarded-For header. Only enable this behind a proxy
+// that sets the header, as otherwise clients can choose their own IP. The
+// default is to use the connection's remote address.
+func WithTrustForwardedFor(trust bool) Option {
+	return func(s *Server) {
+		s.trustForwardedFor = trust
+	}
+}
+
+// WithEscapeHTML sets whether JSON responses escape <, > and & in strings
+// (as \u003c and so on). Escaping is on by default, as with json.Marshal,
+// but API clients that never embed responses in HTML can turn it off for
+// smaller, more readable output.
+func WithEscapeHTML(enabled bool) Option {
+	return func(s *Server) {
+		s.escapeHTML = enabled
+	}
+}
+
+// WithCompactJSON sets whether JSON responses (including errors) are
+// written without indentation, which makes them noticeably smaller,
+// especially for long lists. By default they're indented with four spaces
+// for readability.
+func WithCompactJSON(compact bool) Option {
+	return func(s *Server) {
+		s.compactJSON = compact
+	}
+}
+
+// WithRouteErrorDetails sets whether routing errors include details in
+// their data: the request method and path, the allowed methods for a 405,
+// and for a 404 a "message" explaining what didn't match (for example, an
+// unknown sub-resource of an album). The top-level error codes are the same
+// either way. Details are on by default.
+func WithRouteErrorDetails(enabled bool) Option {
+	return func(s *Server) {
+		s.routeDetails = enabled
+	}
+}
+
+// WithArtistRateLimit limits album creation to at most limit albums per
+// artist within any window-long period, responding with 429 Too Many
+// Requests beyond that. Artist names are compared case-insensitively. Only
+// albums that are actually created count: attempts that fail validation,
+// are rejected by a hook or hit a taken ID don't. It's disabled by default
+// (or if limit is zero).
+func WithArtistRateLimit(limit int, window time.Duration) Option {
+	return func(s *Server) {
+		s.artistLimiter = nil
+		if limit > 0 && window > 0 {
+			s.artistLimiter = newArtistLimiter(limit, window)
+		}
+	}
+}
+
+// WithIDGenerator sets the function used to generate IDs for albums added
+// without one, so tests can use predictable IDs. The generated IDs must be
+// unique; adding an album with a generated ID that's taken fails with 409
+// Conflict. The default generates random 128-bit IDs.
+func WithIDGenerator(newID func() string) Option {
+	return func(s *Server) {
+		s.newID = newID
+	}
+}
+
+// WithPriceRequired sets whether requests that create or replace an album
+// must include a price. By default an omitted price is taken to be zero.
+func WithPriceRequired(required bool) Option {
+	return func(s *Server) {
+		s.rules.PriceRequired = required
+	}
+}
+
+// WithAdminAPI enables the /admin/ routes, such as /admin/maintenance for
+// toggling maintenance mode. They're disabled by default, as they're only
+// authenticated if the server has API keys (see WithAPIKeys): without
+// keys, only enable them where access to the server is otherwise
+// restricted.
+func WithAdminAPI(enabled bool) Option {
+	return func(s *Server) {
+		s.adminAPI = enabled
+	}
+}
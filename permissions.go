@@ -0,0 +1,58 @@
+package main
+
+// FieldPermissions restricts which album fields an update (PUT) may
+// change, for deployments where some fields, such as the price, are only
+// changed by a separate process. Field names are as in the JSON (and
+// albumFields). The zero value allows every field to be changed.
+type FieldPermissions struct {
+	// Allow, if not empty, lists the only fields an update may change.
+	Allow []string
+
+	// Deny lists fields an update may not change, even if allowed.
+	Deny []string
+
+	// Ignore makes the server keep the stored value of a field an update
+	// may not change, instead of rejecting the update with 403 Forbidden.
+	Ignore bool
+}
+
+// restricts reports whether any field may not be changed.
+func (p FieldPermissions) restricts() bool {
+	return len(p.Allow) > 0 || len(p.Deny) > 0
+}
+
+// mayChange reports whether an update may change the named field.
+func (p FieldPermissions) mayChange(name string) bool {
+	for _, denied := range p.Deny {
+		if name == denied {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, allowed := range p.Allow {
+		if name == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// apply checks the update of current to updated against the permissions.
+// It returns the names of the fields that were changed but may not be and,
+// if p.Ignore is set, updated with those fields reset to their current
+// values.
+func (p FieldPermissions) apply(current, updated Album) (Album, []string) {
+	var forbidden []string
+	for _, field := range albumFields {
+		if p.mayChange(field.Name) || field.equal(current, updated) {
+			continue
+		}
+		forbidden = append(forbidden, field.Name)
+		if p.Ignore {
+			field.copy(&updated, current)
+		}
+	}
+	return updated, forbidden
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// queryParser parses and validates query parameters, collecting problems
+// with all of them so a client can be told about every bad parameter in a
+// single ErrorValidation response.
+type queryParser struct {
+	values url.Values
+	issues map[string]any
+}
+
+func newQueryParser(values url.Values) *queryParser {
+	return &queryParser{values: values, issues: make(map[string]any)}
+}
+
+// Int returns the value of the named integer parameter, or def if it's
+// absent or empty. It records an issue (and returns def) if the value isn't
+// an integer, is less than min, or the parameter is given more than once,
+// since it's ambiguous which value the client meant.
+func (q *queryParser) Int(name string, def, min int) int {
+	values := q.values[name]
+	if len(values) > 1 {
+		q.issues[name] = validationIssue{"duplicate", name + " must not be given more than once"}
+		return def
+	}
+	if len(values) == 0 || values[0] == "" {
+		return def
+	}
+	n, err := strconv.Atoi(values[0])
+	if err != nil {
+		q.issues[name] = validationIssue{"invalid", name + " must be an integer"}
+		return def
+	}
+	if n < min {
+		q.issues[name] = validationIssue{"out-of-range", fmt.Sprintf("%s must be at least %d", name, min)}
+		return def
+	}
+	return n
+}
+
+// String returns the value of the named parameter, or "" if it's absent.
+// It records an issue if the parameter is given more than once.
+func (q *queryParser) String(name string) string {
+	values := q.values[name]
+	if len(values) > 1 {
+		q.issues[name] = validationIssue{"duplicate", name + " must not be given more than once"}
+		return ""
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Enum returns the value of the named parameter, which must be one of
+// allowed, or def if it's absent or empty. It records an issue (and returns
+// def) if the value isn't allowed or the parameter is given more than once.
+func (q *queryParser) Enum(name, def string, allowed []string) string {
+	value := q.String(name)
+	if value == "" {
+		return def
+	}
+	for _, a := range allowed {
+		if value == a {
+			return value
+		}
+	}
+	q.issues[name] = validationIssue{"invalid", fmt.Sprintf("%s must be one of: %s", name, strings.Join(allowed, ", "))}
+	return def
+}
+
+// Issues returns the problems found so far, keyed by parameter name.
+func (q *queryParser) Issues() map[string]any {
+	return q.issues
+}
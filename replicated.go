@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// ReplicatedDatabase is a Database that sends writes to a primary database
+// and spreads reads across one or more read replicas, round-robin.
+//
+// Replicas usually lag behind the primary, so a client that writes and then
+// immediately reads may not see its own write. To reduce this, reads made
+// within the "sticky" window after any write are sent to the primary.
+type ReplicatedDatabase struct {
+	primary  Database
+	replicas []Database
+	sticky   time.Duration
+
+	next      atomic.Uint64 // index of the next replica to read from
+	lastWrite atomic.Int64  // time of the last write, in Unix nanoseconds
+}
+
+// NewReplicatedDatabase creates a database that writes to primary and reads
+// from replicas. If sticky is positive, reads within that duration of the
+// last write go to the primary. With no replicas, everything goes to the
+// primary.
+func NewReplicatedDatabase(primary Database, replicas []Database, sticky time.Duration) *ReplicatedDatabase {
+	return &ReplicatedDatabase{primary: primary, replicas: replicas, sticky: sticky}
+}
+
+// reader returns the database to use for a read.
+func (d *ReplicatedDatabase) reader() Database {
+	if len(d.replicas) == 0 {
+		return d.primary
+	}
+	if d.sticky > 0 && time.Since(time.Unix(0, d.lastWrite.Load())) < d.sticky {
+		return d.primary
+	}
+	n := d.next.Add(1) - 1
+	return d.replicas[n%uint64(len(d.replicas))]
+}
+
+// wrote records that a write was just sent to the primary.
+func (d *ReplicatedDatabase) wrote() {
+	d.lastWrite.Store(time.Now().UnixNano())
+}
+
+func (d *ReplicatedDatabase) GetAlbums(ctx context.Context) ([]Album, error) {
+	return d.reader().GetAlbums(ctx)
+}
+
+func (d *ReplicatedDatabase) GetAlbumsPage(ctx context.Context, offset, limit int) ([]Album, int, error) {
+	return d.reader().GetAlbumsPage(ctx, offset, limit)
+}
+
+func (d *ReplicatedDatabase) GetAlbumsFiltered(ctx context.Context, filter AlbumFilter) ([]Album, error) {
+	return d.reader().GetAlbumsFiltered(ctx, filter)
+}
+
+func (d *ReplicatedDatabase) CountAlbums(ctx context.Context, filter AlbumFilter) (int, error) {
+	return d.reader().CountAlbums(ctx, filter)
+}
+
+func (d *ReplicatedDatabase) EachAlbum(ctx context.Context, query AlbumQuery, fn func(Album) error) error {
+	return d.reader().EachAlbum(ctx, query, fn)
+}
+
+func (d *ReplicatedDatabase) GetAlbumsByArtist(ctx context.Context, artist string) ([]Album, error) {
+	return d.reader().GetAlbumsByArtist(ctx, artist)
+}
+
+func (d *ReplicatedDatabase) GetAlbumByID(ctx context.Context, id string) (Album, error) {
+	return d.reader().GetAlbumByID(ctx, id)
+}
+
+func (d *ReplicatedDatabase) AddAlbum(ctx context.Context, album Album) error {
+	defer d.wrote()
+	return d.primary.AddAlbum(ctx, album)
+}
+
+func (d *ReplicatedDatabase) UpdateAlbum(ctx context.Context, album Album, version int) error {
+	defer d.wrote()
+	return d.primary.UpdateAlbum(ctx, album, version)
+}
+
+func (d *ReplicatedDatabase) DeleteAlbum(ctx context.Context, id string) error {
+	defer d.wrote()
+	return d.primary.DeleteAlbum(ctx, id)
+}
+
+func (d *ReplicatedDatabase) GetTracks(ctx context.Context, albumID string) ([]Track, error) {
+	return d.reader().GetTracks(ctx, albumID)
+}
+
+func (d *ReplicatedDatabase) AddTrack(ctx context.Context, albumID string, track Track, maxTracks int) (Track, error) {
+	defer d.wrote()
+	return d.primary.AddTrack(ctx, albumID, track, maxTracks)
+}
+
+func (d *ReplicatedDatabase) ReorderTracks(ctx context.Context, albumID string, trackIDs []string) error {
+	defer d.wrote()
+	return d.primary.ReorderTracks(ctx, albumID, trackIDs)
+}
+
+// Ping checks the primary and every replica, so the database isn't
+// reported as reachable while some reads would fail.
+func (d *ReplicatedDatabase) Ping(ctx context.Context) error {
+	if err := d.primary.Ping(ctx); err != nil {
+		return err
+	}
+	for _, replica := range d.replicas {
+		if err := replica.Ping(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *ReplicatedDatabase) WithTx(ctx context.Context, fn func(tx Database) error) error {
+	defer d.wrote()
+	return d.primary.WithTx(ctx, fn)
+}
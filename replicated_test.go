@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReplicatedRouting(t *testing.T) {
+	ctx := context.Background()
+	primary := NewMemoryDatabase()
+	replicas := []*MemoryDatabase{NewMemoryDatabase(), NewMemoryDatabase()}
+	for i, id := range []string{"r1", "r2"} {
+		// Each replica has a different album, so reads show which one served
+		// them
+		album := Album{ID: id, Title: "T", Artist: "A", ArtistKey: "A", Price: 1}
+		if err := replicas[i].AddAlbum(ctx, album); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db := NewReplicatedDatabase(primary, []Database{replicas[0], replicas[1]}, 0)
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		albums, err := db.GetAlbums(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, albums[0].ID)
+	}
+	if want := []string{"r1", "r2", "r1", "r2"}; !slices.Equal(got, want) {
+		t.Errorf("got reads from %v, want round-robin %v", got, want)
+	}
+
+	err := db.AddAlbum(ctx, Album{ID: "p1", Title: "T", Artist: "A", ArtistKey: "A", Price: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := primary.GetAlbumByID(ctx, "p1"); err != nil {
+		t.Errorf("write didn't go to the primary: %v", err)
+	}
+	for i, replica := range replicas {
+		if _, err := replica.GetAlbumByID(ctx, "p1"); !errors.Is(err, ErrDoesNotExist) {
+			t.Errorf("write went to replica %d", i)
+		}
+	}
+}
+
+func TestReplicatedSticky(t *testing.T) {
+	ctx := context.Background()
+	primary, replica := NewMemoryDatabase(), NewMemoryDatabase()
+	db := NewReplicatedDatabase(primary, []Database{replica}, time.Hour)
+	album := Album{ID: "p1", Title: "T", Artist: "A", ArtistKey: "A", Price: 1}
+	if err := db.AddAlbum(ctx, album); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.GetAlbumByID(ctx, "p1"); err != nil {
+		t.Errorf("read after write didn't go to the primary: %v", err)
+	}
+}
+
+func TestReplicatedPing(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+	}{
+		{"replica up", 0, nil},
+		{"replica down", 1, errDown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replica := newFlakyDatabase(NewMemoryDatabase(), test.failures, errDown)
+			db := NewReplicatedDatabase(NewMemoryDatabase(), []Database{replica}, 0)
+			if err := db.Ping(context.Background()); !errors.Is(err, test.err) {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// DefaultRequestIDHeader is the default header for request IDs (see
+// WithRequestIDHeader).
+const DefaultRequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID accepted from a client.
+const maxRequestIDLength = 128
+
+// requestIDKey is the request context key for the request ID.
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the ID of the request the context belongs
+// to, or "" if it has none, so code handling the request (including the
+// database layer) can log it.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// assignRequestID wraps next to give each request an ID: the one in the
+// request's request ID header if it's valid (see validRequestID), otherwise
+// a generated one. The ID is stored in the request context and echoed in
+// the same response header.
+func (s *Server) assignRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(s.requestIDHeader)
+		if !validRequestID(id) {
+			id = randomID(16)
+		}
+		w.Header().Set(s.requestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validRequestID reports whether a client-supplied request ID can be used:
+// it must be non-empty, not too long, and printable ASCII without spaces,
+// so it can't break up log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// IsTransient reports whether err is a temporary error worth retrying:
+// either it wraps ErrTransient or it has a Temporary method (as net.Error
+// values do) that returns true.
+func IsTransient(err error) bool {
+	if errors.Is(err, ErrTransient) {
+		return true
+	}
+	var temp interface{ Temporary() bool }
+	return errors.As(err, &temp) && temp.Temporary()
+}
+
+// RetryDatabase is a Database decorator that retries operations that fail
+// with a transient error, using exponential backoff with full jitter.
+//
+// Reads are always retried. Of the writes, only idempotent ones (where
+// repeating a successful call has no further effect) are retried; AddAlbum,
+// UpdateAlbum, AddTrack and DeleteAlbum are not, because a retry after a
+// write that did commit would report a spurious ErrAlreadyExists,
+// ErrVersionConflict or ErrDoesNotExist.
+// Errors that aren't transient are returned immediately.
+type RetryDatabase struct {
+	db       Database
+	attempts int
+	delay    time.Duration
+	maxDelay time.Duration
+}
+
+// NewRetryDatabase wraps db so that retryable operations are tried up to
+// attempts times in total. The wait before retry n is a random duration
+// between zero and delay*2^(n-1), capped at maxDelay.
+func NewRetryDatabase(db Database, attempts int, delay, maxDelay time.Duration) *RetryDatabase {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &RetryDatabase{db: db, attempts: attempts, delay: delay, maxDelay: maxDelay}
+}
+
+// retry calls op until it succeeds, fails with a non-transient error, or
+// the attempts run out, and returns the last error. It stops waiting to
+// retry if ctx is done, returning the last error.
+func (d *RetryDatabase) retry(ctx context.Context, op func() error) error {
+	var err error
+	for i := 0; i < d.attempts; i++ {
+		if i > 0 {
+			timer := time.NewTimer(d.backoff(i))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return err
+			}
+		}
+		err = op()
+		if err == nil || !IsTransient(err) {
+			return err
+		}
+	}
+	return err
+}
+
+// backoff returns the jittered wait before the given retry (1-based).
+func (d *RetryDatabase) backoff(retry int) time.Duration {
+	ceiling := d.delay << (retry - 1)
+	if ceiling <= 0 || ceiling > d.maxDelay { // <= 0 catches overflow
+		ceiling = d.maxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func (d *RetryDatabase) GetAlbums(ctx context.Context) ([]Album, error) {
+	var albums []Album
+	err := d.retry(ctx, func() error {
+		var err error
+		albums, err = d.db.GetAlbums(ctx)
+		return err
+	})
+	return albums, err
+}
+
+func (d *RetryDatabase) GetAlbumsPage(ctx context.Context, offset, limit int) ([]Album, int, error) {
+	var albums []Album
+	var total int
+	err := d.retry(ctx, func() error {
+		var err error
+		albums, total, err = d.db.GetAlbumsPage(ctx, offset, limit)
+		return err
+	})
+	return albums, total, err
+}
+
+func (d *RetryDatabase) GetAlbumsFiltered(ctx context.Context, filter AlbumFilter) ([]Album, error) {
+	var albums []Album
+	err := d.retry(ctx, func() error {
+		var err error
+		albums, err = d.db.GetAlbumsFiltered(ctx, filter)
+		return err
+	})
+	return albums, err
+}
+
+func (d *RetryDatabase) CountAlbums(ctx context.Context, filter AlbumFilter) (int, error) {
+	var n int
+	err := d.retry(ctx, func() error {
+		var err error
+		n, err = d.db.CountAlbums(ctx, filter)
+		return err
+	})
+	return n, err
+}
+
+// EachAlbum is only retried if it fails before passing any album to fn, as
+// starting again would repeat them.
+func (d *RetryDatabase) EachAlbum(ctx context.Context, query AlbumQuery, fn func(Album) error) error {
+	var err error
+	called := false
+	d.retry(ctx, func() error {
+		err = d.db.EachAlbum(ctx, query, func(album Album) error {
+			called = true
+			return fn(album)
+		})
+		if called {
+			return nil // stop retrying, but return err below
+		}
+		return err
+	})
+	return err
+}
+
+func (d *RetryDatabase) GetAlbumsByArtist(ctx context.Context, artist string) ([]Album, error) {
+	var albums []Album
+	err := d.retry(ctx, func() error {
+		var err error
+		albums, err = d.db.GetAlbumsByArtist(ctx, artist)
+		return err
+	})
+	return albums, err
+}
+
+func (d *RetryDatabase) GetAlbumByID(ctx context.Context, id string) (Album, error) {
+	var album Album
+	err := d.retry(ctx, func() error {
+		var err error
+		album, err = d.db.GetAlbumByID(ctx, id)
+		return err
+	})
+	return album, err
+}
+
+func (d *RetryDatabase) AddAlbum(ctx context.Context, album Album) error {
+	return d.db.AddAlbum(ctx, album)
+}
+
+func (d *RetryDatabase) UpdateAlbum(ctx context.Context, album Album, version int) error {
+	return d.db.UpdateAlbum(ctx, album, version)
+}
+
+func (d *RetryDatabase) DeleteAlbum(ctx context.Context, id string) error {
+	return d.db.DeleteAlbum(ctx, id)
+}
+
+func (d *RetryDatabase) GetTracks(ctx context.Context, albumID string) ([]Track, error) {
+	var tracks []Track
+	err := d.retry(ctx, func() error {
+		var err error
+		tracks, err = d.db.GetTracks(ctx, albumID)
+		return err
+	})
+	return tracks, err
+}
+
+func (d *RetryDatabase) AddTrack(ctx context.Context, albumID string, track Track, maxTracks int) (Track, error) {
+	return d.db.AddTrack(ctx, albumID, track, maxTracks)
+}
+
+func (d *RetryDatabase) ReorderTracks(ctx context.Context, albumID string, trackIDs []string) error {
+	return d.retry(ctx, func() error {
+		return d.db.ReorderTracks(ctx, albumID, trackIDs)
+	})
+}
+
+func (d *RetryDatabase) Ping(ctx context.Context) error {
+	return d.retry(ctx, func() error {
+		return d.db.Ping(ctx)
+	})
+}
+
+// WithTx isn't retried, as fn may have side effects beyond the database.
+func (d *RetryDatabase) WithTx(ctx context.Context, fn func(tx Database) error) error {
+	return d.db.WithTx(ctx, fn)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+var errReset = fmt.Errorf("%w: connection reset", ErrTransient)
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+		wantErr  error
+		calls    int32
+	}{
+		{"no failures", 0, errReset, nil, 1},
+		{"transient failures", 2, errReset, nil, 3},
+		{"too many transient failures", 3, errReset, errReset, 3},
+		{"permanent failure", 2, errDown, errDown, 1},
+		{"not found", 1, ErrDoesNotExist, ErrDoesNotExist, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flaky := newFlakyDatabase(newTestDB(t), test.failures, test.err)
+			db := NewRetryDatabase(flaky, 3, 0, 0)
+			album, err := db.GetAlbumByID(context.Background(), "a1")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+			if err == nil && album.ID != "a1" {
+				t.Errorf("got album %q, want a1", album.ID)
+			}
+			if calls := flaky.calls.Load(); calls != test.calls {
+				t.Errorf("got %d calls, want %d", calls, test.calls)
+			}
+		})
+	}
+}
+
+func TestRetryEachAlbum(t *testing.T) {
+	flaky := newFlakyDatabase(newTestDB(t), 1, errReset)
+	db := NewRetryDatabase(flaky, 3, 0, 0)
+	var ids []string
+	err := db.EachAlbum(context.Background(), AlbumQuery{}, func(album Album) error {
+		ids = append(ids, album.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[a1 a2]" {
+		t.Errorf("got albums %v, want [a1 a2]", ids)
+	}
+
+	// A failure after some albums were passed on can't be retried
+	errWrite := fmt.Errorf("%w: client went away", ErrTransient)
+	calls := 0
+	err = db.EachAlbum(context.Background(), AlbumQuery{}, func(album Album) error {
+		calls++
+		return errWrite
+	})
+	if !errors.Is(err, errWrite) || calls != 1 {
+		t.Errorf("got error %v after %d calls, want %v after 1", err, calls, errWrite)
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	flaky := newFlakyDatabase(newTestDB(t), 5, errReset)
+	db := NewRetryDatabase(flaky, 5, time.Hour, time.Hour)
+	if _, err := db.GetAlbumByID(ctx, "a1"); !errors.Is(err, errReset) {
+		t.Errorf("got error %v, want %v", err, errReset)
+	}
+	if calls := flaky.calls.Load(); calls != 1 {
+		t.Errorf("got %d calls after the context was canceled, want 1", calls)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// albumSchema returns a JSON Schema document describing the Album type.
+// Property names and types come from the struct's fields and JSON tags (a
+// field without "omitempty" is required), and constraints come from the
+// validation rules, so the schema stays in sync with what Album.Validate
+// accepts.
+func albumSchema(rules ValidationRules) map[string]any {
+	properties := make(map[string]any)
+	required := []string{}
+
+	t := reflect.TypeOf(Album{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if field.Type == reflect.TypeOf(time.Time{}) {
+			// Timestamps are set by the server
+			properties[name] = map[string]any{"type": "string", "format": "date-time", "readOnly": true}
+			continue
+		}
+		property := map[string]any{"type": jsonSchemaType(field.Type)}
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+		if field.Type.Kind() == reflect.String {
+			property["minLength"] = 1
+			if rules.MaxTextLength > 0 {
+				property["maxLength"] = rules.MaxTextLength
+			}
+		}
+		properties[name] = property
+	}
+
+	// The normalized artist is derived from the artist on write
+	if key, ok := properties["artist_key"].(map[string]any); ok {
+		key["readOnly"] = true
+		key["description"] = "normalized artist, used for filtering and grouping"
+	}
+
+	// The ID is generated if omitted when adding, and taken from the URL
+	// when replacing
+	if id, ok := properties["id"].(map[string]any); ok {
+		id["description"] = "generated by the server if omitted"
+		required = slices.DeleteFunc(required, func(name string) bool { return name == "id" })
+	}
+
+	// The version is set by the server, and sent back with updates
+	if version, ok := properties["version"].(map[string]any); ok {
+		version["minimum"] = 1
+		version["description"] = "incremented by each update; updates must give the current version"
+	}
+
+	// Price is in cents, limited to under $1000
+	if price, ok := properties["price"].(map[string]any); ok {
+		price["minimum"] = 0
+		price["exclusiveMaximum"] = maxPrice
+		price["description"] = "price in cents"
+		if rules.PriceRequired {
+			required = append(required, "price")
+		}
+	}
+
+	return map[string]any{
+		"$schema":    "https://json-schema.org/draft/2020-12/schema",
+		"title":      "Album",
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+}
+
+// jsonSchemaType returns the JSON Schema type name for a Go type.
+func jsonSchemaType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	default:
+		return "object"
+	}
+}
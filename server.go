@@ -1,38 +1,178 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Server is the album HTTP server.
 type Server struct {
-	db  Database
-	log *log.Logger
+	db    Database
+	log   *slog.Logger
+	now   func() time.Time
+	newID func() string // generates IDs for albums added without one
+
+	noContentOnEmpty bool
+	robotsTxt        string
+	slashMode        SlashMode
+	rules            ValidationRules
+	escapeHTML       bool
+	compactJSON      bool
+	routeDetails     bool
+	artistLimiter    *artistLimiter
+	artistNorm       ArtistNormalization
+	maxBodyBytes     int64
+	hooks            Hooks
+	serverHeader     *string // nil leaves the Server header alone
+	fieldPerms       FieldPermissions
+	corsOrigins      []string
+	gzipMinSize      int
+	maxListSize      int
+
+	apiKeys            []string
+	authenticatedReads bool
+	clientLimiter      *clientLimiter
+	trustForwardedFor  bool
+	requestIDHeader    string
+	metrics            *metrics
+	tracerProvider     trace.TracerProvider
+
+	adminAPI     bool
+	shuttingDown atomic.Bool
+	maintenance  atomic.Pointer[maintenance]
 }
 
-// NewServer creates a new server using the given database implementation.
-func NewServer(db Database, log *log.Logger) *Server {
-	return &Server{db: db, log: log}
+// defaultRobotsTxt is served at /robots.txt unless overridden with
+// WithRobotsTxt.
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+// DefaultMaxBodyBytes is the default limit on the size of a request body.
+const DefaultMaxBodyBytes = 1 << 20 // 1 MiB
+
+// DefaultMaxListSize is the default cap on the number of albums returned by
+// the unpaginated (NDJSON and CSV) forms of GET /albums.
+const DefaultMaxListSize = 1000
+
+// NewServer creates a new server using the given database implementation,
+// applying any options in order. Without options, it logs to the default
+// slog logger and limits request bodies to DefaultMaxBodyBytes.
+func NewServer(db Database, opts ...Option) *Server {
+	s := &Server{
+		db:              db,
+		log:             slog.Default(),
+		now:             time.Now,
+		newID:           newAlbumID,
+		robotsTxt:       defaultRobotsTxt,
+		escapeHTML:      true,
+		routeDetails:    true,
+		maxBodyBytes:    DefaultMaxBodyBytes,
+		gzipMinSize:     DefaultGzipMinSize,
+		maxListSize:     DefaultMaxListSize,
+		requestIDHeader: DefaultRequestIDHeader,
+		hooks:           NoopHooks{},
+		rules: ValidationRules{
+			MaxTextLength: DefaultMaxTextLength,
+			MaxTracks:     DefaultMaxTracks,
+		},
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.tracerProvider != nil {
+		s.db = NewTracingDatabase(s.db, s.tracerProvider)
+	}
+	return s
+}
+
+// StartShutdown makes the server reject any new requests with a 503 and
+// "Connection: close", so clients retry elsewhere while requests already in
+// progress are allowed to finish. Call it before http.Server.Shutdown.
+func (s *Server) StartShutdown() {
+	s.shuttingDown.Store(true)
 }
 
 // Regex to match "/albums/:id" (id must be one or more non-slash chars).
 var reAlbumsID = regexp.MustCompile(`^/albums/([^/]+)$`)
 
+// Regex to match "/albums/:id/tracks".
+var reAlbumsIDTracks = regexp.MustCompile(`^/albums/([^/]+)/tracks$`)
+
+// Regex to match "/albums/:id/tracks/order".
+var reAlbumsIDTracksOrder = regexp.MustCompile(`^/albums/([^/]+)/tracks/order$`)
+
+// Regex to match "/artists/:name/albums".
+var reArtistsNameAlbums = regexp.MustCompile(`^/artists/([^/]+)/albums$`)
+
 // ServeHTTP routes the request and calls the correct handler based on the URL
 // and HTTP method. It writes a 404 Not Found if the request URL is unknown,
-// or 405 Method Not Allowed if the request method is invalid.
+// or 405 Method Not Allowed if the request method is invalid for the URL.
+// Methods like TRACE that no route supports always get a 405.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path
-	s.log.Printf("%s %s", r.Method, path)
+	// Route on the escaped path so IDs can contain encoded slashes; match
+	// unescapes the IDs it extracts
+	path := r.URL.EscapedPath()
+
+	if s.shuttingDown.Load() {
+		w.Header().Set("Connection", "close")
+		data := map[string]any{"message": "server is shutting down; retry on another instance"}
+		s.jsonError(w, http.StatusServiceUnavailable, ErrorUnavailable, data)
+		return
+	}
+	if s.inMaintenance(w, path) {
+		return
+	}
+	if _, ok := negotiateFormat(r); !ok && negotiated(r, path) {
+		s.notAcceptable(w)
+		return
+	}
+
+	if len(path) > 1 && strings.HasSuffix(path, "/") {
+		switch s.slashMode {
+		case SlashRedirect:
+			u := *r.URL
+			u.Path = localPath(strings.TrimRight(u.Path, "/"))
+			if u.RawPath != "" {
+				u.RawPath = localPath(strings.TrimRight(u.RawPath, "/"))
+			}
+			http.Redirect(w, r, u.RequestURI(), http.StatusPermanentRedirect)
+			return
+		case SlashRewrite:
+			path = strings.TrimRight(path, "/")
+		}
+	}
 
 	var id string
 
 	switch {
+	case path == "/albums/validate":
+		switch r.Method {
+		case "POST":
+			s.validateAlbum(w, r)
+		default:
+			s.methodNotAllowed(w, r, "POST")
+		}
+
+	case path == "/albums/schema":
+		switch r.Method {
+		case "GET":
+			s.writeJSON(w, http.StatusOK, albumSchema(s.rules))
+		default:
+			s.methodNotAllowed(w, r, "GET")
+		}
+
 	case path == "/albums":
 		switch r.Method {
 		case "GET":
@@ -40,111 +180,825 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case "POST":
 			s.addAlbum(w, r)
 		default:
-			w.Header().Set("Allow", "GET, POST")
-			s.jsonError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, nil)
+			s.methodNotAllowed(w, r, "GET, POST")
 		}
 
 	case match(path, reAlbumsID, &id):
 		switch r.Method {
 		case "GET":
 			s.getAlbumByID(w, r, id)
+		case "PUT":
+			s.updateAlbum(w, r, id)
+		case "DELETE":
+			s.deleteAlbum(w, r, id)
+		default:
+			s.methodNotAllowed(w, r, "GET, PUT, DELETE")
+		}
+
+	case match(path, reAlbumsIDTracks, &id):
+		switch r.Method {
+		case "GET":
+			s.getTracks(w, r, id)
+		case "POST":
+			s.addTrack(w, r, id)
 		default:
-			w.Header().Set("Allow", "GET")
-			s.jsonError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, nil)
+			s.methodNotAllowed(w, r, "GET, POST")
+		}
+
+	case match(path, reAlbumsIDTracksOrder, &id):
+		switch r.Method {
+		case "PUT":
+			s.reorderTracks(w, r, id)
+		default:
+			s.methodNotAllowed(w, r, "PUT")
+		}
+
+	case match(path, reArtistsNameAlbums, &id):
+		switch r.Method {
+		case "GET":
+			s.getArtistAlbums(w, r, id)
+		default:
+			s.methodNotAllowed(w, r, "GET")
+		}
+
+	case path == "/admin/maintenance" && s.adminAPI:
+		switch r.Method {
+		case "GET":
+			s.getMaintenance(w, r)
+		case "POST":
+			s.setMaintenance(w, r)
+		default:
+			s.methodNotAllowed(w, r, "GET, POST")
+		}
+
+	case path == "/metrics" && s.metrics != nil:
+		switch r.Method {
+		case "GET":
+			s.getMetrics(w, r)
+		default:
+			s.methodNotAllowed(w, r, "GET")
+		}
+
+	case path == "/healthz":
+		switch r.Method {
+		case "GET":
+			s.getHealthz(w, r)
+		default:
+			s.methodNotAllowed(w, r, "GET")
+		}
+
+	case path == "/readyz":
+		switch r.Method {
+		case "GET":
+			s.getReadyz(w, r)
+		default:
+			s.methodNotAllowed(w, r, "GET")
+		}
+
+	case path == "/favicon.ico":
+		switch r.Method {
+		case "GET":
+			// No icon, but answer so browsers don't log a 404 for every page
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			s.methodNotAllowed(w, r, "GET")
+		}
+
+	case path == "/robots.txt":
+		switch r.Method {
+		case "GET":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, s.robotsTxt)
+		default:
+			s.methodNotAllowed(w, r, "GET")
 		}
 
 	default:
-		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		if !standardMethods[r.Method] {
+			// Reject TRACE, CONNECT and unknown methods outright rather than
+			// implying that some other method might find the resource
+			s.methodNotAllowed(w, r, "")
+			return
+		}
+		var data map[string]any
+		if s.routeDetails {
+			data = map[string]any{
+				"message": notFoundMessage(path),
+				"method":  r.Method,
+				"path":    r.URL.Path,
+			}
+		}
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, data)
 	}
 }
 
+// methodNotAllowed writes a 405 response with the given Allow header (a
+// comma-separated list of methods). With route error details enabled, the
+// request method and path and the allowed methods are included in the
+// error data.
+func (s *Server) methodNotAllowed(w http.ResponseWriter, r *http.Request, allow string) {
+	w.Header().Set("Allow", allow)
+	var data map[string]any
+	if s.routeDetails {
+		allowed := []string{}
+		if allow != "" {
+			allowed = strings.Split(allow, ", ")
+		}
+		data = map[string]any{
+			"method":  r.Method,
+			"path":    r.URL.Path,
+			"allowed": allowed,
+		}
+	}
+	s.jsonError(w, http.StatusMethodNotAllowed, ErrorMethodNotAllowed, data)
+}
+
+// notFoundMessage explains why path didn't match a route, distinguishing
+// unknown resources from unknown or malformed paths under a known resource.
+func notFoundMessage(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if segments[0] == "artists" {
+		return "no route matches this path; artist albums are at /artists/:name/albums"
+	}
+	if segments[0] != "albums" {
+		return fmt.Sprintf("unknown resource %q; the API serves /albums and /artists", "/"+segments[0])
+	}
+	for _, segment := range segments[1:] {
+		if segment == "" {
+			return "path has an empty segment"
+		}
+	}
+	switch {
+	case len(segments) == 3:
+		return fmt.Sprintf("albums have no %q sub-resource; available: tracks", segments[2])
+	case len(segments) == 4 && segments[2] == "tracks":
+		return fmt.Sprintf("album tracks have no %q sub-resource; available: order", segments[3])
+	default:
+		return "no route matches this path under /albums"
+	}
+}
+
+// localPath collapses leading slashes (and backslashes, which browsers
+// treat the same) in a path to one slash, so that redirecting to it can't
+// send the client to another host: "//evil.com" would be a
+// scheme-relative URL.
+func localPath(path string) string {
+	return "/" + strings.TrimLeft(path, `/\`)
+}
+
+// standardMethods are the request methods that the API's routes may
+// support. Any other method gets a 405 regardless of path.
+var standardMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"PATCH":   true,
+	"DELETE":  true,
+	"OPTIONS": true,
+}
+
+// Pagination limits for GET /albums.
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// albumsPage is the response body for GET /albums.
+type albumsPage struct {
+	Albums []Album `json:"albums"`
+	Total  int     `json:"total"`
+	Limit  int     `json:"limit"`
+	Offset int     `json:"offset"`
+}
+
+// getAlbums writes a page of albums in ID order, selected by the "limit"
+// (default 20, clamped to at most 100) and "offset" (default 0) query
+// parameters, along with the total number of matching albums. If the
+// catalog is empty and the server was created with WithNoContentOnEmpty, it
+// writes 204 No Content instead.
+//
+// The "artist" and "title" parameters filter to albums whose artist or
+// title contains the given text, ignoring case; artists are normalized
+// first (see WithArtistNormalization). An empty value doesn't filter. The
+// "sort" parameter (id, title, artist or price) and "order" parameter (asc
+// or desc) change the order from the default of ID ascending. The fields
+// allowed for each are listed in albumFields.
+//
+// If the client accepts "application/x-ndjson", all matching albums are
+// instead streamed one JSON object per line (see streamAlbums). If it
+// accepts "text/csv", or the "format" parameter is "csv", all matching
+// albums are instead written as CSV (see writeAlbumsCSV); "format=json"
+// keeps JSON whatever the Accept header says. Those two forms aren't
+// paginated, so they are capped at maxListSize albums (see capList).
 func (s *Server) getAlbums(w http.ResponseWriter, r *http.Request) {
-	albums, err := s.db.GetAlbums()
+	query := newQueryParser(r.URL.Query())
+	filter := parseAlbumFilter(query)
+	filter.Artist = s.artistNorm.Normalize(filter.Artist)
+	sortField := query.Enum("sort", "id", sortableFields())
+	desc := query.Enum("order", "asc", sortOrders) == "desc"
+	limit := query.Int("limit", defaultPageLimit, 0)
+	offset := query.Int("offset", 0, 0)
+	format := query.Enum("format", "", albumsFormats)
+	if issues := query.Issues(); len(issues) > 0 {
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
+		return
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	asCSV := wantsCSV(r, format)
+	if asCSV || (format == "" && accepts(r, "application/x-ndjson")) {
+		listQuery := AlbumQuery{Filter: filter, Sort: sortField, Desc: desc}
+		if !s.capList(w, r, &listQuery) {
+			return
+		}
+		if asCSV {
+			s.writeAlbumsCSV(w, r, listQuery)
+		} else {
+			s.streamAlbums(w, r, listQuery)
+		}
+		return
+	}
+
+	var albums []Album
+	var total int
+	var err error
+	if filter.IsZero() && sortField == "id" && !desc {
+		albums, total, err = s.db.GetAlbumsPage(r.Context(), offset, limit)
+	} else {
+		// Sort in full before taking the page, as the database's pages are
+		// only in ID order
+		albums, err = s.db.GetAlbumsFiltered(r.Context(), filter)
+		total = len(albums)
+		sortAlbums(albums, sortField, desc)
+		albums = paginate(albums, offset, limit)
+	}
 	if err != nil {
-		s.log.Printf("error fetching albums: %v", err)
-		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		s.logger(r).Error("error fetching albums", "error", err)
+		s.databaseError(w, err)
+		return
+	}
+	if total == 0 && filter.IsZero() && s.noContentOnEmpty {
+		// Only for an empty catalog: a filter that matches nothing gets
+		// an empty page
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
-	s.writeJSON(w, http.StatusOK, albums)
+	if albums == nil {
+		albums = []Album{} // a nil slice would marshal as "null"
+	}
+	s.writeResponse(w, r, http.StatusOK, albumsPage{
+		Albums: albums,
+		Total:  total,
+		Limit:  limit,
+		Offset: offset,
+	})
 }
 
-func (s *Server) addAlbum(w http.ResponseWriter, r *http.Request) {
-	var album Album
-	if !s.readJSON(w, r, &album) {
+// getArtistAlbums writes a page of the albums by the named artist, in ID
+// order, using the same "limit" and "offset" parameters as getAlbums. The
+// name must match the artist exactly once both are normalized (see
+// WithArtistNormalization); it writes 404 Not Found if the artist
+// has no albums.
+func (s *Server) getArtistAlbums(w http.ResponseWriter, r *http.Request, artist string) {
+	query := newQueryParser(r.URL.Query())
+	limit := query.Int("limit", defaultPageLimit, 0)
+	offset := query.Int("offset", 0, 0)
+	if issues := query.Issues(); len(issues) > 0 {
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
 		return
 	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
 
-	// Validate the input and build a map of validation issues
-	type validationIssue struct {
-		Error   string `json:"error"`
-		Message string `json:"message,omitempty"`
+	albums, err := s.db.GetAlbumsByArtist(r.Context(), s.artistNorm.Normalize(artist))
+	if err != nil {
+		s.logger(r).Error("error fetching albums for artist", "artist", artist, "error", err)
+		s.databaseError(w, err)
+		return
 	}
-	issues := make(map[string]any)
-	if album.ID == "" {
-		issues["id"] = validationIssue{"required", ""}
+	if len(albums) == 0 {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
 	}
-	if album.Title == "" {
-		issues["title"] = validationIssue{"required", ""}
+	s.writeResponse(w, r, http.StatusOK, albumsPage{
+		Albums: paginate(albums, offset, limit),
+		Total:  len(albums),
+		Limit:  limit,
+		Offset: offset,
+	})
+}
+
+// paginate returns the page of albums selected by offset and limit.
+func paginate(albums []Album, offset, limit int) []Album {
+	if offset >= len(albums) {
+		return []Album{}
 	}
-	if album.Artist == "" {
-		issues["artist"] = validationIssue{"required", ""}
+	albums = albums[offset:]
+	if limit < len(albums) {
+		albums = albums[:limit]
 	}
-	if album.Price < 0 || album.Price >= 100000 {
-		issues["price"] = validationIssue{"out-of-range", "price must be between 0 and $1000"}
+	return albums
+}
+
+// capList limits query to maxListSize albums, to protect the server and
+// clients from huge unpaginated responses. When that cuts the list short,
+// it sets an "X-Truncated: true" header and "X-Total-Count" to the full
+// number of matching albums, nudging the client towards pagination. It
+// writes an error and returns false if it can't count the albums.
+func (s *Server) capList(w http.ResponseWriter, r *http.Request, query *AlbumQuery) bool {
+	if s.maxListSize <= 0 {
+		return true
 	}
-	if len(issues) > 0 {
+	total, err := s.db.CountAlbums(r.Context(), query.Filter)
+	if err != nil {
+		s.logger(r).Error("error counting albums", "error", err)
+		s.databaseError(w, err)
+		return false
+	}
+	if total > s.maxListSize {
+		w.Header().Set("X-Truncated", "true")
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	}
+	query.Limit = s.maxListSize
+	return true
+}
+
+// eachAlbum writes the albums selected by query one at a time with write,
+// as the database's EachAlbum passes them. The first album, or the end of
+// an empty list, calls start to write the response header. If the catalog
+// is empty (there are no albums and query has no filter) it writes 204 No
+// Content instead if the server was created with WithNoContentOnEmpty. It
+// returns true if all the albums were written, or false if it stopped (if
+// it stopped before start, it has written an error response).
+func (s *Server) eachAlbum(w http.ResponseWriter, r *http.Request, query AlbumQuery, start func(), write func(Album) error) bool {
+	started := false
+	written := 0
+	var writeErr error
+	err := s.db.EachAlbum(r.Context(), query, func(album Album) error {
+		if !started {
+			start()
+			started = true
+		}
+		if writeErr = write(album); writeErr != nil {
+			return writeErr
+		}
+		written++
+		return nil
+	})
+	switch {
+	case writeErr != nil:
+		// Usually because the client disconnected
+		s.logger(r).Warn("stopped writing albums", "written", written, "error", writeErr)
+		return false
+	case err != nil && !started:
+		s.logger(r).Error("error fetching albums", "error", err)
+		s.databaseError(w, err)
+		return false
+	case err != nil:
+		// Too late to change the status, so the client gets a short list
+		s.logger(r).Error("error fetching albums", "written", written, "error", err)
+		return false
+	case !started && query.Filter.IsZero() && s.noContentOnEmpty:
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	case !started:
+		start()
+	}
+	return true
+}
+
+// ndjsonFlushEvery is how many albums streamAlbums writes between flushes.
+const ndjsonFlushEvery = 100
+
+// streamAlbums writes the albums selected by query as newline-delimited
+// JSON, encoding and writing each one as EachAlbum passes it (see
+// eachAlbum) rather than building the whole response in memory, and flushing
+// periodically so the client can start processing early. It isn't
+// paginated; getAlbums caps the list instead.
+func (s *Server) streamAlbums(w http.ResponseWriter, r *http.Request, query AlbumQuery) {
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(s.escapeHTML)
+	written := 0
+	start := func() {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+	}
+	ok := s.eachAlbum(w, r, query, start, func(album Album) error {
+		if err := encoder.Encode(album); err != nil {
+			return err
+		}
+		written++
+		if flusher != nil && written%ndjsonFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if ok && flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// addAlbum adds the album in the request body, or all the albums if the
+// body is a JSON array (see addAlbums). An album without an ID gets a
+// generated one (see WithIDGenerator). The response has a Location header
+// with the new album's URL path.
+func (s *Server) addAlbum(w http.ResponseWriter, r *http.Request) {
+	if bodyIsArray(r) {
+		s.addAlbums(w, r)
+		return
+	}
+	album, hasPrice, ok := s.readAlbum(w, r)
+	if !ok {
+		return
+	}
+	if album.ID == "" {
+		album.ID = s.newID()
+	}
+
+	if issues := s.validate(album, hasPrice); len(issues) > 0 {
 		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
 		return
 	}
 
-	err := s.db.AddAlbum(album)
+	release, ok := s.limitArtists(w, []string{album.ArtistKey})
+	if !ok {
+		return
+	}
+
+	album.Version = 1 // as AddAlbum stores it
+	album.CreatedAt = s.now().UTC()
+	album.UpdatedAt = album.CreatedAt
+	if !s.beforeWrite(w, r, ActionAdd, album) {
+		release()
+		return
+	}
+	err := s.db.AddAlbum(r.Context(), album)
+	if err != nil {
+		release() // only albums that are created count against the limit
+	}
 	if errors.Is(err, ErrAlreadyExists) {
 		s.jsonError(w, http.StatusConflict, ErrorAlreadyExists, nil)
 		return
 	} else if err != nil {
-		s.log.Printf("error adding album ID %q: %v", album.ID, err)
-		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		s.logger(r).Error("error adding album", "id", album.ID, "error", err)
+		s.databaseError(w, err)
 		return
 	}
+	s.hooks.OnAfterWrite(r.Context(), ActionAdd, album)
 
-	s.writeJSON(w, http.StatusCreated, album)
+	w.Header().Set("Location", albumLocation(album.ID))
+	s.writeResponse(w, r, http.StatusCreated, album)
 }
 
+// validateAlbum runs the same validation as addAlbum without touching the
+// database, so clients can check input before submitting it. It doesn't
+// check whether the ID is already taken, and an empty ID is valid as
+// addAlbum would generate one.
+func (s *Server) validateAlbum(w http.ResponseWriter, r *http.Request) {
+	album, hasPrice, ok := s.readAlbum(w, r)
+	if !ok {
+		return
+	}
+	issues := s.validate(album, hasPrice)
+	if album.ID == "" {
+		delete(issues, "id")
+	}
+	if len(issues) > 0 {
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, map[string]any{"valid": true})
+}
+
+// getAlbumByID writes the album with the given ID, with a strong ETag (see
+// albumETag). If the request's If-None-Match header matches the ETag, it
+// writes 304 Not Modified with no body instead.
 func (s *Server) getAlbumByID(w http.ResponseWriter, r *http.Request, id string) {
-	album, err := s.db.GetAlbumByID(id)
+	album, err := s.db.GetAlbumByID(r.Context(), id)
+	if errors.Is(err, ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if err != nil {
+		s.logger(r).Error("error fetching album", "id", id, "error", err)
+		s.databaseError(w, err)
+		return
+	}
+	format, _ := negotiateFormat(r)
+	etag := albumETag(album, format)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r, etag) {
+		w.Header().Add("Vary", "Accept")
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	s.writeResponse(w, r, http.StatusOK, album)
+}
+
+// updateAlbum replaces an existing album with the request body. The ID in
+// the path is used if the body omits "id"; a body ID that differs from the
+// path is a validation error. Changes to fields that the server's
+// FieldPermissions don't allow are rejected with 403 Forbidden, or ignored.
+//
+// The request must give the album's current version, in an If-Match header
+// (the album's ETag, or just its version, like If-Match: "3") or the body's
+// "version" field, and gets 409 Conflict if the album has been updated
+// since (see expectedVersion).
+func (s *Server) updateAlbum(w http.ResponseWriter, r *http.Request, id string) {
+	album, hasPrice, ok := s.readAlbum(w, r)
+	if !ok {
+		return
+	}
+	version, ok := s.expectedVersion(w, r, album)
+	if !ok {
+		return
+	}
+
+	if album.ID != "" && album.ID != id {
+		issues := map[string]any{"id": validationIssue{"mismatch", "id must match the album ID in the URL"}}
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
+		return
+	}
+	album.ID = id
+	if issues := s.validate(album, hasPrice); len(issues) > 0 {
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
+		return
+	}
+
+	current, err := s.db.GetAlbumByID(r.Context(), id)
+	if errors.Is(err, ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if err != nil {
+		s.logger(r).Error("error fetching album", "id", id, "error", err)
+		s.databaseError(w, err)
+		return
+	}
+	album.CreatedAt = current.CreatedAt
+	album.UpdatedAt = s.now().UTC()
+	if s.fieldPerms.restricts() {
+		var forbidden []string
+		album, forbidden = s.fieldPerms.apply(current, album)
+		if len(forbidden) > 0 && !s.fieldPerms.Ignore {
+			data := map[string]any{
+				"message": "these fields may not be changed",
+				"fields":  forbidden,
+			}
+			s.jsonError(w, http.StatusForbidden, ErrorForbidden, data)
+			return
+		}
+	}
+
+	if !s.beforeWrite(w, r, ActionUpdate, album) {
+		return
+	}
+	err = s.db.UpdateAlbum(r.Context(), album, version)
+	if errors.Is(err, ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if errors.Is(err, ErrVersionConflict) {
+		data := map[string]any{"message": "the album has been changed since this version; fetch it and try again"}
+		s.jsonError(w, http.StatusConflict, ErrorVersionConflict, data)
+		return
+	} else if err != nil {
+		s.logger(r).Error("error updating album", "id", id, "error", err)
+		s.databaseError(w, err)
+		return
+	}
+	album.Version = version + 1
+	s.hooks.OnAfterWrite(r.Context(), ActionUpdate, album)
+
+	s.writeResponse(w, r, http.StatusOK, album)
+}
+
+// expectedVersion returns the album version an update expects, from the
+// If-Match header (the ETag from getAlbumByID, or a bare version number)
+// or the body's version. It writes a validation error and returns false
+// if neither is given, the header isn't a version, or the two differ.
+func (s *Server) expectedVersion(w http.ResponseWriter, r *http.Request, body Album) (int, bool) {
+	version := body.Version
+	if value := r.Header.Get("If-Match"); value != "" {
+		n, valid := etagVersion(value)
+		var issue *validationIssue
+		switch {
+		case !valid:
+			issue = &validationIssue{"invalid", "If-Match must be the album's ETag or version, like \"3\""}
+		case version != 0 && version != n:
+			issue = &validationIssue{"mismatch", "version must match the If-Match header"}
+		}
+		if issue != nil {
+			s.jsonError(w, http.StatusBadRequest, ErrorValidation, map[string]any{"version": *issue})
+			return 0, false
+		}
+		version = n
+	}
+	if version == 0 {
+		issue := validationIssue{"required", "send the album's current version in an If-Match header or the body"}
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, map[string]any{"version": issue})
+		return 0, false
+	}
+	return version, true
+}
+
+func (s *Server) deleteAlbum(w http.ResponseWriter, r *http.Request, id string) {
+	if !s.beforeWrite(w, r, ActionDelete, Album{ID: id}) {
+		return
+	}
+	err := s.db.DeleteAlbum(r.Context(), id)
+	if errors.Is(err, ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if err != nil {
+		s.logger(r).Error("error deleting album", "id", id, "error", err)
+		s.databaseError(w, err)
+		return
+	}
+	s.hooks.OnAfterWrite(r.Context(), ActionDelete, Album{ID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getTracks(w http.ResponseWriter, r *http.Request, albumID string) {
+	tracks, err := s.db.GetTracks(r.Context(), albumID)
+	if errors.Is(err, ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if err != nil {
+		s.logger(r).Error("error fetching tracks", "album_id", albumID, "error", err)
+		s.databaseError(w, err)
+		return
+	}
+	s.writeResponse(w, r, http.StatusOK, tracks)
+}
+
+func (s *Server) addTrack(w http.ResponseWriter, r *http.Request, albumID string) {
+	var track Track
+	if !s.readJSON(w, r, &track) {
+		return
+	}
+
+	if issues := track.Validate(s.rules); len(issues) > 0 {
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
+		return
+	}
+
+	added, err := s.db.AddTrack(r.Context(), albumID, track, s.rules.MaxTracks)
+	if errors.Is(err, ErrTooManyTracks) {
+		message := fmt.Sprintf("an album may have at most %d tracks", s.rules.MaxTracks)
+		issues := map[string]any{"tracks": validationIssue{"too-many", message}}
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
+		return
+	} else if errors.Is(err, ErrDoesNotExist) {
+		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
+		return
+	} else if errors.Is(err, ErrAlreadyExists) {
+		s.jsonError(w, http.StatusConflict, ErrorAlreadyExists, nil)
+		return
+	} else if err != nil {
+		s.logger(r).Error("error adding track", "album_id", albumID, "track_id", track.ID, "error", err)
+		s.databaseError(w, err)
+		return
+	}
+
+	s.writeResponse(w, r, http.StatusCreated, added)
+}
+
+func (s *Server) reorderTracks(w http.ResponseWriter, r *http.Request, albumID string) {
+	var order struct {
+		TrackIDs []string `json:"track_ids"`
+	}
+	if !s.readJSON(w, r, &order) {
+		return
+	}
+
+	err := s.db.ReorderTracks(r.Context(), albumID, order.TrackIDs)
 	if errors.Is(err, ErrDoesNotExist) {
 		s.jsonError(w, http.StatusNotFound, ErrorNotFound, nil)
 		return
+	} else if errors.Is(err, ErrTrackMismatch) {
+		issues := map[string]any{
+			"track_ids": validationIssue{"mismatch", "track_ids must list each of the album's track IDs exactly once"},
+		}
+		s.jsonError(w, http.StatusBadRequest, ErrorValidation, issues)
+		return
 	} else if err != nil {
-		s.log.Printf("error fetching album ID %q: %v", id, err)
-		s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+		s.logger(r).Error("error reordering tracks", "album_id", albumID, "error", err)
+		s.databaseError(w, err)
+		return
+	}
+
+	s.getTracks(w, r, albumID)
+}
+
+// databaseError writes the error response for an unexpected database error:
+// 503 if the database is unavailable, otherwise a 500.
+func (s *Server) databaseError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrUnavailable) {
+		s.jsonError(w, http.StatusServiceUnavailable, ErrorUnavailable, nil)
 		return
 	}
-	s.writeJSON(w, http.StatusOK, album)
+	s.jsonError(w, http.StatusInternalServerError, ErrorDatabase, nil)
+}
+
+// emptyBody writes a 400 response for a request with no body.
+func (s *Server) emptyBody(w http.ResponseWriter) {
+	data := map[string]any{"message": "request body is empty; send the data as JSON in the request body"}
+	s.jsonError(w, http.StatusBadRequest, ErrorEmptyBody, data)
+}
+
+// unknownField returns the field name from an "unknown field" error
+// returned by a json.Decoder with DisallowUnknownFields set.
+func unknownField(err error) (string, bool) {
+	// encoding/json has no error type for this, so match the message
+	quoted := strings.TrimPrefix(err.Error(), "json: unknown field ")
+	if quoted == err.Error() {
+		return "", false
+	}
+	field, err := strconv.Unquote(quoted)
+	if err != nil {
+		return "", false
+	}
+	return field, true
+}
+
+// readAlbum reads an album from the JSON request body, handling errors like
+// readJSON. It also reports whether the body included a price, as an
+// omitted price otherwise decodes to the (valid) price of zero.
+func (s *Server) readAlbum(w http.ResponseWriter, r *http.Request) (album Album, hasPrice bool, ok bool) {
+	var body albumInput
+	if !s.readJSON(w, r, &body) {
+		return Album{}, false, false
+	}
+	album, hasPrice = s.fromInput(body)
+	return album, hasPrice, true
+}
+
+// albumInput is an album as decoded from a request body, noting whether
+// the price was given.
+type albumInput struct {
+	Album
+	Price *int `json:"price"` // takes precedence over Album.Price when decoding
+}
+
+// fromInput returns the album from a decoded request body with its artist
+// key set, and whether the body included a price. Timestamps in the body
+// are ignored, as the server sets them.
+func (s *Server) fromInput(body albumInput) (album Album, hasPrice bool) {
+	album = body.Album
+	album.CreatedAt, album.UpdatedAt = time.Time{}, time.Time{}
+	if body.Price != nil {
+		album.Price = *body.Price
+	}
+	album.ArtistKey = s.artistNorm.Normalize(album.Artist)
+	return album, body.Price != nil
+}
+
+// validate returns the validation issues for an album read by readAlbum,
+// including a missing price if the server's rules require one.
+func (s *Server) validate(album Album, hasPrice bool) map[string]any {
+	issues := album.Validate(s.rules)
+	if s.rules.PriceRequired && !hasPrice {
+		issues["price"] = validationIssue{"required", ""}
+	}
+	return issues
 }
 
 // writeJSON marshals v to JSON and writes it to the response, handling
 // errors as appropriate. It also sets the Content-Type header to
-// "application/json".
+// "application/json". HTML characters (<, > and &) in strings are escaped
+// unless disabled with WithEscapeHTML, and the output is indented unless
+// the server was created with WithCompactJSON.
 func (s *Server) writeJSON(w http.ResponseWriter, status int, v any) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	b, err := json.MarshalIndent(v, "", "    ")
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	if !s.compactJSON {
+		encoder.SetIndent("", "    ")
+	}
+	encoder.SetEscapeHTML(s.escapeHTML)
+	err := encoder.Encode(v)
 	if err != nil {
-		s.log.Printf("error marshaling JSON: %v", err)
+		s.log.Error("error marshaling JSON", "error", err)
 		http.Error(w, `{"error":"`+ErrorInternal+`"}`, http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(status)
-	_, err = w.Write(b)
+	_, err = w.Write(buf.Bytes())
 	if err != nil {
 		// Very unlikely to happen, but log any error (not much more we can do)
-		s.log.Printf("error writing JSON: %v", err)
+		s.log.Error("error writing JSON", "error", err)
 	}
 }
 
 // jsonError writes a structured error as JSON to the response, with
-// optional structured data in the "data" field.
+// optional structured data in the "data" field. Error responses are marked
+// as non-cacheable so proxies and browsers don't serve stale errors.
 func (s *Server) jsonError(w http.ResponseWriter, status int, error string, data map[string]any) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache") // for HTTP/1.0 caches
 	response := struct {
 		Status int            `json:"status"`
 		Error  string         `json:"error"`
@@ -157,21 +1011,112 @@ func (s *Server) jsonError(w http.ResponseWriter, status int, error string, data
 	s.writeJSON(w, status, response)
 }
 
-// readJSON reads the request body and unmarshal it from JSON, handling
-// errors as appropriate. It returns true on success; the caller should
-// return from the handler early if it returns false.
+// readJSON decodes the request body from JSON as it reads it, handling
+// errors as appropriate. A leading UTF-8 byte order mark is ignored, but
+// anything other than whitespace after the JSON value is an error, as is an
+// object field that v doesn't have (usually a typo or wrong case). It
+// returns true on success; the caller should return from the handler early
+// if it returns false. A body larger than the server's limit (see
+// WithMaxBodyBytes) gets a 413 response, and a request whose Content-Type
+// isn't JSON (see isJSONContentType) gets a 415. An empty body (or one
+// that's only whitespace) gets a 400 ErrorEmptyBody response, even without
+// a Content-Type, as a forgotten body is the likelier mistake.
 func (s *Server) readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
-	b, err := io.ReadAll(r.Body)
-	if err != nil {
-		s.log.Printf("error reading JSON body: %v", err)
+	if r.ContentLength == 0 {
+		s.emptyBody(w)
+		return false
+	}
+	if !isJSONContentType(r.Header.Get("Content-Type")) {
+		s.unsupportedMediaType(w)
+		return false
+	}
+	body := &bodyReader{Reader: r.Body}
+	if s.maxBodyBytes > 0 {
+		body.Reader = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	}
+	br := bufio.NewReader(body)
+	if bom, _ := br.Peek(3); string(bom) == "\xef\xbb\xbf" {
+		br.Discard(3)
+	}
+	err := skipSpace(br)
+	if err == io.EOF {
+		s.emptyBody(w)
+		return false
+	}
+	if err == nil {
+		decoder := json.NewDecoder(br)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(v)
+		if err == nil {
+			// Decode stops after the first value, so check there's nothing else
+			err = skipSpace(bufio.NewReader(io.MultiReader(decoder.Buffered(), br)))
+			if err == io.EOF {
+				return true
+			} else if err == nil {
+				err = errors.New("unexpected data after JSON value")
+			}
+		}
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(body.err, &tooLarge) {
+		data := map[string]any{
+			"message": fmt.Sprintf("request body must not be larger than %d bytes", tooLarge.Limit),
+			"limit":   tooLarge.Limit,
+		}
+		s.jsonError(w, http.StatusRequestEntityTooLarge, ErrorBodyTooLarge, data)
+		return false
+	} else if body.err != nil {
+		s.logger(r).Error("error reading JSON body", "error", body.err)
 		s.jsonError(w, http.StatusInternalServerError, ErrorInternal, nil)
 		return false
 	}
-	err = json.Unmarshal(b, v)
 	if err != nil {
-		data := map[string]any{"message": err.Error()}
+		message := err.Error()
+		data := map[string]any{}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field == "" && typeErr.Value == "array" {
+			// Common mistake: sending a list of items to an endpoint that
+			// takes a single item
+			message = "expected a single JSON object, not an array; send one item per request"
+		} else if field, ok := unknownField(err); ok {
+			message = fmt.Sprintf("unknown field %q; check the spelling and case of the field name", field)
+			data["field"] = field
+		}
+		data["message"] = message
 		s.jsonError(w, http.StatusBadRequest, ErrorMalformedJSON, data)
 		return false
 	}
 	return true
 }
+
+// bodyReader is a request body that remembers the first error, other than
+// io.EOF, from reading it, so readJSON can tell a body it couldn't read
+// from one that isn't valid JSON.
+type bodyReader struct {
+	io.Reader
+	err error
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// skipSpace reads past JSON whitespace, returning io.EOF if there's
+// nothing else to read.
+func skipSpace(r *bufio.Reader) error {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+		default:
+			return r.UnreadByte()
+		}
+	}
+}
@@ -0,0 +1,1276 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newTestDB returns an in-memory database with two albums, a1 and a2.
+func newTestDB(t *testing.T) *MemoryDatabase {
+	t.Helper()
+	db := NewMemoryDatabase()
+	for _, album := range []Album{
+		{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795},
+		{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000},
+	} {
+		if err := db.AddAlbum(context.Background(), album); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// newTestServer returns the Handler of a server for a test database, with
+// logs discarded unless an option sets a logger.
+func newTestServer(t *testing.T, opts ...Option) http.Handler {
+	t.Helper()
+	return newServerFor(newTestDB(t), opts...)
+}
+
+// newServerFor returns the Handler of a server for db, with logs discarded
+// unless an option sets a logger.
+func newServerFor(db Database, opts ...Option) http.Handler {
+	opts = append([]Option{WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))}, opts...)
+	return NewServer(db, opts...).Handler()
+}
+
+// errorResponse decodes a response written by jsonError.
+func errorResponse(t *testing.T, w *httptest.ResponseRecorder) (code string, data map[string]any) {
+	t.Helper()
+	var response struct {
+		Error string         `json:"error"`
+		Data  map[string]any `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("decoding error response %q: %v", w.Body, err)
+	}
+	return response.Error, response.Data
+}
+
+// serve sends a request to h and returns the response. The headers are
+// given as name, value pairs, and empty values are skipped; a body gets a
+// JSON Content-Type unless the headers set one.
+func serve(h http.Handler, method, target, body string, headers ...string) *httptest.ResponseRecorder {
+	var bodyReader io.Reader
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, target, bodyReader)
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		if headers[i+1] != "" {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestSlashRedirect(t *testing.T) {
+	h := newTestServer(t, WithSlashMode(SlashRedirect))
+	tests := []struct {
+		target   string
+		location string
+	}{
+		{"/albums/", "/albums"},
+		{"/albums/a1//", "/albums/a1"},
+		{"/albums/?limit=1", "/albums?limit=1"},
+		{"//evil.com/", "/evil.com"},
+		{"///evil.com/", "/evil.com"},
+		{`/\evil.com/`, "/evil.com"},
+		{"//evil.com/albums/", "/evil.com/albums"},
+	}
+	for _, test := range tests {
+		w := serve(h, "GET", test.target, "")
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("GET %s: got status %d, want %d", test.target, w.Code, http.StatusPermanentRedirect)
+			continue
+		}
+		if location := w.Header().Get("Location"); location != test.location {
+			t.Errorf("GET %s: got Location %q, want %q", test.target, location, test.location)
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	album := `{"id":"a3","title":"Blue Train","artist":"John Coltrane","price":5699}`
+	tests := []struct {
+		name   string
+		reads  bool
+		method string
+		target string
+		body   string
+		key    string
+		status int
+	}{
+		{"public read", false, "GET", "/albums", "", "", http.StatusOK},
+		{"write without key", false, "POST", "/albums", album, "", http.StatusUnauthorized},
+		{"write with key", false, "POST", "/albums", album, "secret", http.StatusCreated},
+		{"write with wrong key", false, "POST", "/albums", album, "wrong", http.StatusUnauthorized},
+		{"validate without key", false, "POST", "/albums/validate", album, "", http.StatusOK},
+		{"health check", true, "GET", "/healthz", "", "", http.StatusOK},
+		{"authenticated read without key", true, "GET", "/albums", "", "", http.StatusUnauthorized},
+		{"authenticated read with key", true, "GET", "/albums", "", "secret", http.StatusOK},
+		{"authenticated validate without key", true, "POST", "/albums/validate", album, "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestServer(t, WithAPIKeys("secret"), WithAuthenticatedReads(test.reads))
+			var headers []string
+			if test.key != "" {
+				headers = []string{"Authorization", "Bearer " + test.key}
+			}
+			w := serve(h, test.method, test.target, test.body, headers...)
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestUpdateWithETag(t *testing.T) {
+	h := newTestServer(t)
+	get := serve(h, "GET", "/albums/a1", "")
+	etag := get.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("GET: no ETag")
+	}
+	body := `{"title":"9th Symphony","artist":"Beethoven","price":999}`
+
+	w := serve(h, "PUT", "/albums/a1", body, "If-Match", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT with ETag %s: got status %d, want %d: %s", etag, w.Code, http.StatusOK, w.Body)
+	}
+	after := serve(h, "GET", "/albums/a1", "")
+	if newETag := after.Header().Get("ETag"); newETag == etag {
+		t.Errorf("ETag %s didn't change after update", etag)
+	}
+
+	w = serve(h, "PUT", "/albums/a1", body, "If-Match", etag)
+	if w.Code != http.StatusConflict {
+		t.Errorf("PUT with stale ETag: got status %d, want %d", w.Code, http.StatusConflict)
+	}
+	w = serve(h, "PUT", "/albums/a1", body, "If-Match", after.Header().Get("ETag"))
+	if w.Code != http.StatusOK {
+		t.Errorf("PUT with new ETag: got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestExpectedVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		ifMatch string
+		status  int
+	}{
+		{"quoted version", `{"title":"T","artist":"A","price":1}`, `"1"`, http.StatusOK},
+		{"bare version", `{"title":"T","artist":"A","price":1}`, `1`, http.StatusOK},
+		{"ETag", `{"title":"T","artist":"A","price":1}`, `"1-9f86d081884c7d65"`, http.StatusOK},
+		{"body version", `{"title":"T","artist":"A","price":1,"version":1}`, "", http.StatusOK},
+		{"stale version", `{"title":"T","artist":"A","price":1}`, `"2"`, http.StatusConflict},
+		{"no version", `{"title":"T","artist":"A","price":1}`, "", http.StatusBadRequest},
+		{"invalid If-Match", `{"title":"T","artist":"A","price":1}`, `"abc"`, http.StatusBadRequest},
+		{"mismatch", `{"title":"T","artist":"A","price":1,"version":2}`, `"1"`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestServer(t)
+			var headers []string
+			if test.ifMatch != "" {
+				headers = []string{"If-Match", test.ifMatch}
+			}
+			w := serve(h, "PUT", "/albums/a1", test.body, headers...)
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+		})
+	}
+}
+
+func TestMaxListSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int
+		accept    string
+		target    string
+		lines     int
+		truncated string
+		total     string
+	}{
+		{"ndjson capped", 1, "application/x-ndjson", "/albums", 1, "true", "2"},
+		{"ndjson under cap", 2, "application/x-ndjson", "/albums", 2, "", ""},
+		{"ndjson no cap", 0, "application/x-ndjson", "/albums", 2, "", ""},
+		{"csv capped", 1, "", "/albums?format=csv", 2, "true", "2"}, // header row plus one album
+		{"csv under cap", 5, "", "/albums?format=csv", 3, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestServer(t, WithMaxListSize(test.max))
+			var headers []string
+			if test.accept != "" {
+				headers = []string{"Accept", test.accept}
+			}
+			w := serve(h, "GET", test.target, "", headers...)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if lines := strings.Count(w.Body.String(), "\n"); lines != test.lines {
+				t.Errorf("got %d lines, want %d:\n%s", lines, test.lines, w.Body)
+			}
+			if got := w.Header().Get("X-Truncated"); got != test.truncated {
+				t.Errorf("got X-Truncated %q, want %q", got, test.truncated)
+			}
+			if got := w.Header().Get("X-Total-Count"); got != test.total {
+				t.Errorf("got X-Total-Count %q, want %q", got, test.total)
+			}
+		})
+	}
+}
+
+func TestStreamAlbums(t *testing.T) {
+	sqliteDB, err := NewSQLiteDatabase(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqliteDB.Close() })
+	databases := map[string]Database{"memory": NewMemoryDatabase(), "sqlite": sqliteDB}
+	albums := []Album{
+		{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", Price: 795},
+		{ID: "a2", Title: "Hey Jude", Artist: "The Beatles", Price: 2000},
+		{ID: "a3", Title: "abbey road", Artist: "The Beatles", Price: 1500},
+	}
+	tests := []struct {
+		target string
+		accept string
+		body   string
+	}{
+		{"/albums", "application/x-ndjson", "a1 a2 a3"},
+		{"/albums?sort=price&order=desc", "application/x-ndjson", "a2 a3 a1"},
+		{"/albums?sort=title", "application/x-ndjson", "a1 a3 a2"},
+		{"/albums?artist=beatles&sort=title&order=desc", "application/x-ndjson", "a2 a3"},
+		{"/albums?title=nothing", "application/x-ndjson", ""},
+		{"/albums?format=csv&sort=price", "", "id a1 a3 a2"},
+	}
+	for name, db := range databases {
+		for _, album := range albums {
+			album.ArtistKey = album.Artist
+			if err := db.AddAlbum(context.Background(), album); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h := newServerFor(db)
+		for _, test := range tests {
+			w := serve(h, "GET", test.target, "", "Accept", test.accept)
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: GET %s: got status %d, want %d", name, test.target, w.Code, http.StatusOK)
+				continue
+			}
+			if got := firstFields(w.Body.String()); got != test.body {
+				t.Errorf("%s: GET %s: got albums %q, want %q", name, test.target, got, test.body)
+			}
+		}
+	}
+}
+
+func TestSortIDs(t *testing.T) {
+	tests := []struct {
+		target string
+		accept string
+		want   string
+	}{
+		{"/albums", "", "B1 C1 a1"},
+		{"/albums?sort=id", "", "B1 C1 a1"},
+		{"/albums?sort=id&order=desc", "", "a1 C1 B1"},
+		{"/albums", "application/x-ndjson", "B1 C1 a1"},
+		{"/albums?sort=id", "application/x-ndjson", "B1 C1 a1"},
+		{"/albums?sort=id&order=desc", "application/x-ndjson", "a1 C1 B1"},
+	}
+	for name, db := range testDatabases(t) {
+		for _, id := range []string{"a1", "B1", "C1"} {
+			if err := db.AddAlbum(context.Background(), Album{ID: id, Title: "T", Artist: "A", ArtistKey: "A", Price: 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h := newServerFor(db)
+		for _, test := range tests {
+			w := serve(h, "GET", test.target, "", "Accept", test.accept)
+			if w.Code != http.StatusOK {
+				t.Errorf("%s: GET %s: got status %d, want %d", name, test.target, w.Code, http.StatusOK)
+				continue
+			}
+			var got string
+			if test.accept == "" {
+				var page albumsPage
+				if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+					t.Fatal(err)
+				}
+				var ids []string
+				for _, album := range page.Albums {
+					ids = append(ids, album.ID)
+				}
+				got = strings.Join(ids, " ")
+			} else {
+				got = firstFields(w.Body.String())
+			}
+			if got != test.want {
+				t.Errorf("%s: GET %s (%s): got albums %q, want %q", name, test.target, test.accept, got, test.want)
+			}
+		}
+	}
+}
+
+// firstFields returns the IDs (or first CSV cells) of each line of an NDJSON
+// or CSV body, separated by spaces.
+func firstFields(body string) string {
+	var ids []string
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, `{"id":"`) {
+			line = strings.TrimPrefix(line, `{"id":"`)
+			line, _, _ = strings.Cut(line, `"`)
+		} else {
+			line, _, _ = strings.Cut(line, ",")
+		}
+		ids = append(ids, line)
+	}
+	return strings.Join(ids, " ")
+}
+
+func TestNotAcceptable(t *testing.T) {
+	h := newTestServer(t, WithMetrics(prometheus.NewRegistry()))
+	tests := []struct {
+		target string
+		accept string
+		status int
+	}{
+		{"/albums", "text/plain", http.StatusNotAcceptable},
+		{"/albums/a1", "image/png", http.StatusNotAcceptable},
+		{"/albums/a1", "application/msgpack", http.StatusOK},
+		{"/albums?format=csv", "text/plain", http.StatusOK},
+		{"/healthz", "text/plain", http.StatusOK},
+		{"/readyz", "text/plain", http.StatusOK},
+		{"/metrics", "text/plain", http.StatusOK},
+		{"/robots.txt", "text/plain", http.StatusOK},
+	}
+	for _, test := range tests {
+		w := serve(h, "GET", test.target, "", "Accept", test.accept)
+		if w.Code != test.status {
+			t.Errorf("GET %s with Accept %s: got status %d, want %d", test.target, test.accept, w.Code, test.status)
+		}
+	}
+}
+
+func TestEmptyCatalog(t *testing.T) {
+	tests := []struct {
+		name      string
+		albums    bool // whether the catalog has albums
+		noContent bool
+		target    string
+		accept    string
+		status    int
+		body      string
+	}{
+		{"empty array by default", false, false, "/albums", "", http.StatusOK, `{"albums":[],"total":0,"limit":20,"offset":0}`},
+		{"204 if configured", false, true, "/albums", "", http.StatusNoContent, ""},
+		{"empty filtered list", false, false, "/albums?artist=nobody", "", http.StatusOK, `{"albums":[],"total":0,"limit":20,"offset":0}`},
+		{"empty NDJSON", false, false, "/albums", "application/x-ndjson", http.StatusOK, ""},
+		{"204 NDJSON", false, true, "/albums", "application/x-ndjson", http.StatusNoContent, ""},
+		{"204 CSV", false, true, "/albums?format=csv", "", http.StatusNoContent, ""},
+		// Only an empty catalog gets a 204, not a list that's empty
+		{"no match", true, true, "/albums?artist=nobody", "", http.StatusOK, `{"albums":[],"total":0,"limit":20,"offset":0}`},
+		{"offset past the end", true, true, "/albums?offset=5", "", http.StatusOK, `{"albums":[],"total":2,"limit":20,"offset":5}`},
+		{"no match NDJSON", true, true, "/albums?title=nothing", "application/x-ndjson", http.StatusOK, ""},
+		{"no match CSV", true, true, "/albums?title=nothing&format=csv", "", http.StatusOK, "id,title,artist,price"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db := NewMemoryDatabase()
+			if test.albums {
+				db = newTestDB(t)
+			}
+			h := newServerFor(db, WithNoContentOnEmpty(test.noContent), WithCompactJSON(true))
+			w := serve(h, "GET", test.target, "", "Accept", test.accept)
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+			if body := strings.TrimSpace(w.Body.String()); body != test.body {
+				t.Errorf("got body %q, want %q", body, test.body)
+			}
+		})
+	}
+}
+
+func TestErrorsNotCached(t *testing.T) {
+	flaky := newFlakyDatabase(newTestDB(t), 1, errDown)
+	h := newServerFor(flaky)
+	tests := []struct {
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"GET", "/albums/a1", "", http.StatusInternalServerError}, // the flaky database fails once
+		{"GET", "/albums/missing", "", http.StatusNotFound},
+		{"DELETE", "/albums", "", http.StatusMethodNotAllowed},
+		{"POST", "/albums", `{"title":""}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := serve(h, test.method, test.target, test.body)
+		if w.Code != test.status {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.target, w.Code, test.status)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("%s %s: got Cache-Control %q, want no-store", test.method, test.target, got)
+		}
+		if got := w.Header().Get("Pragma"); got != "no-cache" {
+			t.Errorf("%s %s: got Pragma %q, want no-cache", test.method, test.target, got)
+		}
+	}
+
+	w := serve(h, "GET", "/albums/a1", "")
+	if w.Code != http.StatusOK || w.Header().Get("Cache-Control") == "no-store" {
+		t.Errorf("got status %d and Cache-Control %q for a successful GET, want 200 without no-store",
+			w.Code, w.Header().Get("Cache-Control"))
+	}
+}
+
+func TestMaxTextLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		title  string
+		artist string
+		field  string // the field with an issue, if any
+	}{
+		{"at limit", strings.Repeat("a", 10), "A", ""},
+		{"over limit", strings.Repeat("a", 11), "A", "title"},
+		{"multibyte at limit", strings.Repeat("é", 10), "A", ""}, // 20 bytes
+		{"multibyte over limit", "A", strings.Repeat("日", 11), "artist"},
+		{"empty", "", "A", "title"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestServer(t, WithMaxTextLength(10))
+			body, _ := json.Marshal(map[string]any{"id": "x1", "title": test.title, "artist": test.artist, "price": 100})
+			w := serve(h, "POST", "/albums/validate", string(body))
+			if test.field == "" {
+				if w.Code != http.StatusOK {
+					t.Errorf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+				}
+				return
+			}
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusBadRequest)
+			}
+			code, data := errorResponse(t, w)
+			if code != ErrorValidation || data[test.field] == nil {
+				t.Errorf("got error %q with data %v, want %q for %s", code, data, ErrorValidation, test.field)
+			}
+		})
+	}
+}
+
+func TestReadJSONFraming(t *testing.T) {
+	const album = `{"id":"a3","title":"Blue Train","artist":"John Coltrane","price":5699}`
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+	}{
+		{"plain", album, http.StatusOK, ""},
+		{"byte order mark", "\ufeff" + album, http.StatusOK, ""},
+		{"trailing whitespace", album + " \n\t", http.StatusOK, ""},
+		{"trailing garbage", album + "x", http.StatusBadRequest, ErrorMalformedJSON},
+		{"second value", album + album, http.StatusBadRequest, ErrorMalformedJSON},
+		{"byte order mark and garbage", "\ufeff" + album + "}", http.StatusBadRequest, ErrorMalformedJSON},
+		{"truncated", album[:40], http.StatusBadRequest, ErrorMalformedJSON},
+		{"only whitespace", " \n\t", http.StatusBadRequest, ErrorEmptyBody},
+		{"only byte order mark", "\ufeff\n", http.StatusBadRequest, ErrorEmptyBody},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := serve(newTestServer(t), "POST", "/albums/validate", test.body)
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			if test.code != "" {
+				if code, _ := errorResponse(t, w); code != test.code {
+					t.Errorf("got error %q, want %q", code, test.code)
+				}
+			}
+		})
+	}
+}
+
+func TestMaxTracks(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := db.AddAlbum(context.Background(), Album{ID: "a1", Title: "T", Artist: "A", ArtistKey: "A", Price: 1}); err != nil {
+				t.Fatal(err)
+			}
+			h := newServerFor(db, WithMaxTracks(2))
+			for i, status := range []int{http.StatusCreated, http.StatusCreated, http.StatusBadRequest} {
+				body := fmt.Sprintf(`{"id":"t%d","title":"Track %d","duration":60}`, i+1, i+1)
+				w := serve(h, "POST", "/albums/a1/tracks", body)
+				if w.Code != status {
+					t.Fatalf("track %d: got status %d, want %d: %s", i+1, w.Code, status, w.Body)
+				}
+				if status != http.StatusBadRequest {
+					continue
+				}
+				code, data := errorResponse(t, w)
+				issue, _ := data["tracks"].(map[string]any)
+				if code != ErrorValidation || issue["error"] != "too-many" {
+					t.Errorf("track %d: got error %q with data %v, want a too-many issue for tracks", i+1, code, data)
+				}
+			}
+			w := serve(h, "GET", "/albums/a1/tracks", "")
+			var tracks []Track
+			if err := json.Unmarshal(w.Body.Bytes(), &tracks); err != nil {
+				t.Fatal(err)
+			}
+			if len(tracks) != 2 {
+				t.Errorf("got %d tracks, want 2", len(tracks))
+			}
+		})
+	}
+}
+
+func TestEncodedIDs(t *testing.T) {
+	db := newTestDB(t)
+	for _, id := range []string{"a b", "x/y", "50%", "é"} {
+		if err := db.AddAlbum(context.Background(), Album{ID: id, Title: "T", Artist: "A", Price: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newServerFor(db)
+	tests := []struct {
+		target string
+		status int
+		id     string
+	}{
+		{"/albums/a%20b", http.StatusOK, "a b"},
+		{"/albums/x%2Fy", http.StatusOK, "x/y"},
+		{"/albums/x%2fy", http.StatusOK, "x/y"},
+		{"/albums/50%25", http.StatusOK, "50%"},
+		{"/albums/%C3%A9", http.StatusOK, "é"},
+		{"/albums/x/y", http.StatusNotFound, ""},
+		{"/albums/a%20c", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		w := serve(h, "GET", test.target, "")
+		if w.Code != test.status {
+			t.Errorf("GET %s: got status %d, want %d", test.target, w.Code, test.status)
+			continue
+		}
+		if test.id == "" {
+			continue
+		}
+		var album Album
+		if err := json.Unmarshal(w.Body.Bytes(), &album); err != nil {
+			t.Fatal(err)
+		}
+		if album.ID != test.id {
+			t.Errorf("GET %s: got album %q, want %q", test.target, album.ID, test.id)
+		}
+	}
+
+	w := serve(h, "POST", "/albums", `{"id":"new/one","title":"T","artist":"A","price":1}`)
+	if location := w.Header().Get("Location"); w.Code != http.StatusCreated || location != "/albums/new%2Fone" {
+		t.Errorf("POST: got status %d and Location %q, want %d and /albums/new%%2Fone", w.Code, location, http.StatusCreated)
+	}
+}
+
+func TestUnsupportedMethods(t *testing.T) {
+	h := newTestServer(t)
+	tests := []struct {
+		method string
+		target string
+		allow  string
+	}{
+		{"TRACE", "/albums", "GET, POST"},
+		{"BREW", "/albums", "GET, POST"},
+		{"DELETE", "/albums", "GET, POST"},
+		{"TRACE", "/robots.txt", "GET"},
+		{"TRACE", "/albums/a1", ""},
+		{"TRACE", "/albums/missing", ""},
+	}
+	for _, test := range tests {
+		w := serve(h, test.method, test.target, "")
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: got status %d, want %d", test.method, test.target, w.Code, http.StatusMethodNotAllowed)
+			continue
+		}
+		allow := w.Header().Get("Allow")
+		if test.allow != "" && allow != test.allow {
+			t.Errorf("%s %s: got Allow %q, want %q", test.method, test.target, allow, test.allow)
+		}
+		if allow == "" || strings.Contains(allow, "TRACE") {
+			t.Errorf("%s %s: got Allow %q, want the route's methods", test.method, test.target, allow)
+		}
+		if code, _ := errorResponse(t, w); code != ErrorMethodNotAllowed {
+			t.Errorf("%s %s: got error %q, want %q", test.method, test.target, code, ErrorMethodNotAllowed)
+		}
+	}
+}
+
+func TestRouteErrorDetails(t *testing.T) {
+	tests := []struct {
+		name    string
+		details bool
+		method  string
+		target  string
+		code    string
+		data    map[string]any
+	}{
+		{"404", true, "GET", "/nope", ErrorNotFound, map[string]any{"method": "GET", "path": "/nope"}},
+		{"405", true, "PUT", "/albums", ErrorMethodNotAllowed, map[string]any{"method": "PUT", "path": "/albums", "allowed": []any{"GET", "POST"}}},
+		{"404 without details", false, "GET", "/nope", ErrorNotFound, nil},
+		{"405 without details", false, "PUT", "/albums", ErrorMethodNotAllowed, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestServer(t, WithRouteErrorDetails(test.details))
+			w := serve(h, test.method, test.target, "")
+			code, data := errorResponse(t, w)
+			if code != test.code {
+				t.Errorf("got error %q, want %q", code, test.code)
+			}
+			if test.data == nil && data != nil {
+				t.Errorf("got data %v, want none", data)
+			}
+			for key, want := range test.data {
+				if got := data[key]; !reflect.DeepEqual(got, want) {
+					t.Errorf("got %s %v, want %v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+// panickyDatabase is a MemoryDatabase whose GetAlbumByID panics with value.
+type panickyDatabase struct {
+	*MemoryDatabase
+	value any
+}
+
+func (d panickyDatabase) GetAlbumByID(ctx context.Context, id string) (Album, error) {
+	panic(d.value)
+}
+
+func TestRecoverPanics(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  any
+		status int
+	}{
+		{"string", "boom", http.StatusInternalServerError},
+		{"error", errors.New("boom"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&logs, nil))
+			h := newServerFor(panickyDatabase{newTestDB(t), test.value}, WithLogger(logger))
+			w := serve(h, "GET", "/albums/a1", "")
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+			if code, _ := errorResponse(t, w); code != ErrorInternal {
+				t.Errorf("got error %q, want %q", code, ErrorInternal)
+			}
+			if !strings.Contains(logs.String(), "panic serving request") || !strings.Contains(logs.String(), "boom") {
+				t.Errorf("panic wasn't logged:\n%s", logs.String())
+			}
+		})
+	}
+
+	t.Run("abort", func(t *testing.T) {
+		h := NewServer(newTestDB(t)).recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic(http.ErrAbortHandler)
+		}))
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Errorf("got panic %v, want http.ErrAbortHandler to be passed on", v)
+			}
+		}()
+		serve(h, "GET", "/albums", "")
+	})
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	album := `{"id":"a3","title":"Blue Train","artist":"John Coltrane","price":5699}` // 70 bytes
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{"under limit", "POST", "/albums", album, http.StatusCreated},
+		{"padded to limit", "POST", "/albums/validate", album + strings.Repeat(" ", 40), http.StatusOK},
+		{"over limit", "POST", "/albums", album + strings.Repeat(" ", 41), http.StatusRequestEntityTooLarge},
+		{"large title", "POST", "/albums", `{"title":"` + strings.Repeat("a", 1000) + `"}`, http.StatusRequestEntityTooLarge},
+		{"bulk over limit", "POST", "/albums", "[" + album + "," + album + "]", http.StatusRequestEntityTooLarge},
+		{"update over limit", "PUT", "/albums/a1", album + strings.Repeat(" ", 41), http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestServer(t, WithMaxBodyBytes(110))
+			w := serve(h, test.method, test.target, test.body)
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			if w.Code == http.StatusRequestEntityTooLarge {
+				if code, _ := errorResponse(t, w); code != ErrorBodyTooLarge {
+					t.Errorf("got error %q, want %q", code, ErrorBodyTooLarge)
+				}
+			}
+		})
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []Option
+		inner string // Server header set by the wrapped handler
+		want  string
+	}{
+		{"default", nil, "", ""},
+		{"default keeps inner", nil, "inner/1.0", "inner/1.0"},
+		{"set", []Option{WithServerHeader("albums/1.0")}, "", "albums/1.0"},
+		{"set overrides inner", []Option{WithServerHeader("albums/1.0")}, "inner/1.0", "albums/1.0"},
+		{"strip", []Option{WithServerHeader("")}, "inner/1.0", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewServer(newTestDB(t), test.opts...)
+			var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.inner != "" {
+					w.Header().Set("Server", test.inner)
+				}
+				w.Write([]byte("ok"))
+			})
+			if s.serverHeader != nil {
+				h = setServerHeader(h, *s.serverHeader)
+			}
+			w := serve(h, "GET", "/", "")
+			if _, ok := w.Header()["Server"]; ok != (test.want != "") || w.Header().Get("Server") != test.want {
+				t.Errorf("got Server header %q, want %q", w.Header().Values("Server"), test.want)
+			}
+		})
+	}
+
+	w := serve(newTestServer(t, WithServerHeader("albums/1.0")), "GET", "/albums/missing", "")
+	if got := w.Header().Get("Server"); got != "albums/1.0" {
+		t.Errorf("got Server header %q on an error response, want albums/1.0", got)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	h := newTestServer(t, WithGzipMinSize(100))
+	tests := []struct {
+		name           string
+		target         string
+		acceptEncoding string
+		accept         string
+		compressed     bool
+	}{
+		{"large list", "/albums", "gzip", "", true},
+		{"large list with q", "/albums", "br;q=1, gzip;q=0.5", "", true},
+		{"gzip refused", "/albums", "gzip;q=0", "", false},
+		{"no Accept-Encoding", "/albums", "", "", false},
+		{"NDJSON stream", "/albums", "gzip", "application/x-ndjson", true},
+		{"small response", "/healthz", "gzip", "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plain := serve(h, "GET", test.target, "", "Accept", test.accept)
+			w := serve(h, "GET", test.target, "", "Accept", test.accept, "Accept-Encoding", test.acceptEncoding)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+			if !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+				t.Errorf("got Vary %q, want Accept-Encoding", w.Header().Get("Vary"))
+			}
+			if got := w.Header().Get("Content-Encoding") == "gzip"; got != test.compressed {
+				t.Fatalf("got Content-Encoding %q, want compressed %v", w.Header().Get("Content-Encoding"), test.compressed)
+			}
+			body := w.Body.Bytes()
+			if test.compressed {
+				if w.Header().Get("Content-Length") != "" {
+					t.Errorf("got Content-Length %q for a compressed body", w.Header().Get("Content-Length"))
+				}
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(body, plain.Body.Bytes()) {
+				t.Errorf("got body %q, want %q", body, plain.Body)
+			}
+		})
+	}
+}
+
+func TestClientRateLimit(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := NewServer(newTestDB(t), WithClientRateLimit(1, 2), WithTrustForwardedFor(true),
+		WithNow(func() time.Time { return now }),
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	h := s.Handler()
+	steps := []struct {
+		advance    time.Duration
+		client     string
+		target     string
+		status     int
+		retryAfter string
+	}{
+		{0, "198.51.100.1", "/albums", http.StatusOK, ""},
+		{0, "198.51.100.1", "/albums", http.StatusOK, ""},
+		{0, "198.51.100.1", "/albums", http.StatusTooManyRequests, "1"},
+		{0, "198.51.100.2", "/albums", http.StatusOK, ""},  // another client has its own bucket
+		{0, "198.51.100.1", "/healthz", http.StatusOK, ""}, // health checks aren't limited
+		{500 * time.Millisecond, "198.51.100.1", "/albums", http.StatusTooManyRequests, "1"},
+		{500 * time.Millisecond, "198.51.100.1", "/albums", http.StatusOK, ""}, // one token refilled
+		{0, "198.51.100.1", "/albums", http.StatusTooManyRequests, "1"},
+		{time.Minute, "198.51.100.1", "/albums", http.StatusOK, ""},
+		{0, "198.51.100.1", "/albums", http.StatusOK, ""}, // refilled to the burst
+		{0, "198.51.100.1", "/albums", http.StatusTooManyRequests, "1"},
+	}
+	for i, step := range steps {
+		now = now.Add(step.advance)
+		w := serve(h, "GET", step.target, "", "X-Forwarded-For", step.client)
+		if w.Code != step.status {
+			t.Fatalf("step %d: got status %d, want %d", i+1, w.Code, step.status)
+		}
+		if got := w.Header().Get("Retry-After"); got != step.retryAfter {
+			t.Errorf("step %d: got Retry-After %q, want %q", i+1, got, step.retryAfter)
+		}
+		if w.Code == http.StatusTooManyRequests {
+			if code, _ := errorResponse(t, w); code != ErrorRateLimited {
+				t.Errorf("step %d: got error %q, want %q", i+1, code, ErrorRateLimited)
+			}
+		}
+	}
+
+	// Idle clients' buckets are dropped
+	now = now.Add(time.Hour)
+	serve(h, "GET", "/albums", "", "X-Forwarded-For", "198.51.100.3")
+	if n := len(s.clientLimiter.buckets); n != 1 {
+		t.Errorf("got %d buckets after the others went idle, want 1", n)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	h := newTestServer(t)
+	first := serve(h, "GET", "/albums/a1", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("got status %d and ETag %q, want 200 with an ETag", first.Code, etag)
+	}
+	if again := serve(h, "GET", "/albums/a1", "").Header().Get("ETag"); again != etag {
+		t.Errorf("ETag changed from %s to %s without an update", etag, again)
+	}
+	msgpackETag := serve(h, "GET", "/albums/a1", "", "Accept", "application/msgpack").Header().Get("ETag")
+	if msgpackETag == etag {
+		t.Errorf("msgpack and JSON representations have the same ETag %s", etag)
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		accept      string
+		status      int
+	}{
+		{"match", etag, "", http.StatusNotModified},
+		{"weak match", "W/" + etag, "", http.StatusNotModified},
+		{"in list", `"other", ` + etag, "", http.StatusNotModified},
+		{"any", "*", "", http.StatusNotModified},
+		{"no match", `"other"`, "", http.StatusOK},
+		{"other format", etag, "application/msgpack", http.StatusOK},
+		{"msgpack match", msgpackETag, "application/msgpack", http.StatusNotModified},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := serve(h, "GET", "/albums/a1", "", "If-None-Match", test.ifNoneMatch, "Accept", test.accept)
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+			if w.Header().Get("ETag") == "" {
+				t.Errorf("no ETag")
+			}
+			if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("got body %q with 304", w.Body)
+			}
+		})
+	}
+
+	serve(h, "PUT", "/albums/a1", `{"title":"T","artist":"A","price":1,"version":1}`)
+	w := serve(h, "GET", "/albums/a1", "", "If-None-Match", etag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after an update, got status %d and ETag %s, want 200 with a new ETag", w.Code, w.Header().Get("ETag"))
+	}
+
+	// A re-created album starts again at version 1 but mustn't match the
+	// old album's ETag
+	oldETag := serve(h, "GET", "/albums/a2", "").Header().Get("ETag")
+	serve(h, "DELETE", "/albums/a2", "")
+	serve(h, "POST", "/albums", `{"id":"a2","title":"Let It Be","artist":"The Beatles","price":1500}`)
+	w = serve(h, "GET", "/albums/a2", "", "If-None-Match", oldETag)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == oldETag {
+		t.Errorf("after re-creating an album, got status %d and ETag %s, want 200 with a new ETag", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			now := created
+			h := newServerFor(db, WithNow(func() time.Time { return now }))
+			steps := []struct {
+				method    string
+				target    string
+				body      string
+				createdAt time.Time
+				updatedAt time.Time
+			}{
+				// Timestamps from the client are ignored
+				{"POST", "/albums", `{"id":"t1","title":"T","artist":"A","price":1,"created_at":"2000-01-01T00:00:00Z","updated_at":"2000-01-01T00:00:00Z"}`, created, created},
+				{"GET", "/albums/t1", "", created, created},
+				{"PUT", "/albums/t1", `{"title":"U","artist":"A","price":1,"version":1,"created_at":"2000-01-01T00:00:00Z"}`, created, created.Add(time.Hour)},
+				{"GET", "/albums/t1", "", created, created.Add(time.Hour)},
+			}
+			for _, step := range steps {
+				if step.method == "PUT" {
+					now = now.Add(time.Hour)
+				}
+				w := serve(h, step.method, step.target, step.body)
+				if w.Code >= 300 {
+					t.Fatalf("%s %s: got status %d: %s", step.method, step.target, w.Code, w.Body)
+				}
+				var album Album
+				if err := json.Unmarshal(w.Body.Bytes(), &album); err != nil {
+					t.Fatal(err)
+				}
+				if !album.CreatedAt.Equal(step.createdAt) || !album.UpdatedAt.Equal(step.updatedAt) {
+					t.Errorf("%s %s: got created_at %v and updated_at %v, want %v and %v", step.method, step.target,
+						album.CreatedAt, album.UpdatedAt, step.createdAt, step.updatedAt)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string // configured header name
+		incoming string // value sent in the header
+		want     string // expected ID, or "" for a generated one
+	}{
+		{"generated", DefaultRequestIDHeader, "", ""},
+		{"incoming", DefaultRequestIDHeader, "abc-123", "abc-123"},
+		{"invalid incoming", DefaultRequestIDHeader, "has space", ""},
+		{"too long incoming", DefaultRequestIDHeader, strings.Repeat("a", maxRequestIDLength+1), ""},
+		{"custom header", "X-Correlation-ID", "abc-123", "abc-123"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(&logs, nil))
+			// Log every database operation as slow, to check the ID gets there too
+			db := NewTimingDatabase(newTestDB(t), logger, time.Nanosecond)
+			h := newServerFor(db, WithLogger(logger), WithRequestIDHeader(test.header))
+			w := serve(h, "GET", "/albums/a1", "", test.header, test.incoming)
+
+			id := w.Header().Get(test.header)
+			switch {
+			case id == "":
+				t.Fatalf("no %s header in response", test.header)
+			case test.want != "" && id != test.want:
+				t.Errorf("got ID %q, want %q", id, test.want)
+			case test.want == "" && id == test.incoming:
+				t.Errorf("got ID %q, want a generated one", id)
+			}
+			for _, message := range []string{"slow database operation", "request"} {
+				if !strings.Contains(logs.String(), "msg=\""+message+"\"") && !strings.Contains(logs.String(), "msg="+message+" ") {
+					t.Errorf("no %q log line:\n%s", message, logs.String())
+				}
+			}
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				if !strings.Contains(line, "request_id="+id) {
+					t.Errorf("log line has no request_id=%s: %s", id, line)
+				}
+			}
+		})
+	}
+
+	w := serve(newTestServer(t, WithRequestIDHeader("")), "GET", "/albums/a1", "")
+	if id := w.Header().Get(DefaultRequestIDHeader); id != "" {
+		t.Errorf("got %s %q with request IDs disabled", DefaultRequestIDHeader, id)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	const album = `{"title":"Blue Train","artist":"John Coltrane","price":5699}`
+	tests := []struct {
+		contentType string
+		status      int
+	}{
+		{"application/json", http.StatusOK},
+		{"application/json; charset=utf-8", http.StatusOK},
+		{"Application/JSON; charset=UTF-8", http.StatusOK},
+		{"", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"application/json; charset=latin1", http.StatusUnsupportedMediaType},
+		{"application/json; charset", http.StatusUnsupportedMediaType}, // malformed
+	}
+	for _, method := range []string{"POST", "PUT"} {
+		for _, test := range tests {
+			h := newTestServer(t)
+			target := "/albums/validate"
+			if method == "PUT" {
+				target = "/albums/a1"
+			}
+			r := httptest.NewRequest(method, target, strings.NewReader(album))
+			if test.contentType != "" {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			r.Header.Set("If-Match", `"1"`)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Errorf("%s with Content-Type %q: got status %d, want %d: %s", method, test.contentType, w.Code, test.status, w.Body)
+				continue
+			}
+			if test.status == http.StatusUnsupportedMediaType {
+				if code, _ := errorResponse(t, w); code != ErrorUnsupportedMediaType {
+					t.Errorf("%s with Content-Type %q: got error %q, want %q", method, test.contentType, code, ErrorUnsupportedMediaType)
+				}
+			}
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		key    string
+		status int
+	}{
+		{"off by default", nil, "", http.StatusNotFound},
+		{"on", []Option{WithMetrics(prometheus.NewRegistry())}, "", http.StatusOK},
+		{"authenticated without key", []Option{WithMetrics(prometheus.NewRegistry()), WithAPIKeys("secret"), WithAuthenticatedReads(true)}, "", http.StatusUnauthorized},
+		{"authenticated with key", []Option{WithMetrics(prometheus.NewRegistry()), WithAPIKeys("secret"), WithAuthenticatedReads(true)}, "secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := serve(newTestServer(t, test.opts...), "GET", "/metrics", "", "X-API-Key", test.key)
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestAlbumsCSV(t *testing.T) {
+	db := NewMemoryDatabase()
+	for _, album := range []Album{
+		{ID: "a1", Title: "Free Album", Artist: "A", ArtistKey: "A", Price: 0},
+		{ID: "a2", Title: `=HYPERLINK("http://example.com")`, Artist: "@B", ArtistKey: "@B", Price: 795},
+	} {
+		if err := db.AddAlbum(context.Background(), album); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := serve(newServerFor(db), "GET", "/albums?format=csv", "")
+	want := "id,title,artist,price\n" +
+		"a1,Free Album,A,0.00\n" +
+		`a2,"'=HYPERLINK(""http://example.com"")",'@B,7.95` + "\n"
+	if w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("got status %d and body:\n%s\nwant 200 and:\n%s", w.Code, w.Body, want)
+	}
+	if got := w.Header().Get("Content-Type"); got != "text/csv; charset=utf-8" {
+		t.Errorf("got Content-Type %q, want text/csv; charset=utf-8", got)
+	}
+}
+
+// recordingHooks is a Hooks that records the IDs of albums passed to it,
+// and rejects writes of the album with ID reject.
+type recordingHooks struct {
+	reject string
+	before []string
+	after  []string
+}
+
+func (h *recordingHooks) OnBeforeWrite(ctx context.Context, action WriteAction, album Album) error {
+	h.before = append(h.before, album.ID)
+	if album.ID == h.reject {
+		return fmt.Errorf("%w: album %s isn't allowed", ErrRejected, album.ID)
+	}
+	return nil
+}
+
+func (h *recordingHooks) OnAfterWrite(ctx context.Context, action WriteAction, album Album) {
+	h.after = append(h.after, album.ID)
+}
+
+func TestAddAlbums(t *testing.T) {
+	album := func(id string) string {
+		return `{"id":"` + id + `","title":"T","artist":"A","price":1}`
+	}
+	tests := []struct {
+		name   string
+		body   string
+		reject string // album ID for the hook to reject
+		status int
+		issues []string       // indexes with validation issues, for a 400
+		data   map[string]any // error data, for a 409
+		before []string       // albums passed to OnBeforeWrite
+	}{
+		{"added", "[" + album("a3") + "," + album("a4") + "]", "", http.StatusCreated, nil, nil, []string{"a3", "a4"}},
+		{"invalid", "[" + album("a3") + `,{"id":"a4","artist":"A","price":1},` + album("a3") + "]", "", http.StatusBadRequest, []string{"1", "2"}, nil, nil},
+		{"empty", "[]", "", http.StatusBadRequest, []string{"albums"}, nil, nil},
+		{"taken ID", "[" + album("a3") + "," + album("a1") + "]", "", http.StatusConflict, nil, map[string]any{"index": 1.0, "id": "a1"}, nil},
+		{"rejected by hook", "[" + album("a3") + "," + album("a4") + "]", "a4", http.StatusBadRequest, nil, nil, []string{"a3", "a4"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hooks := &recordingHooks{reject: test.reject}
+			h := newTestServer(t, WithHooks(hooks))
+			w := serve(h, "POST", "/albums", test.body)
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			if w.Code >= 400 {
+				_, data := errorResponse(t, w)
+				if test.issues != nil {
+					var got []string
+					for key := range data {
+						got = append(got, key)
+					}
+					sort.Strings(got)
+					if !reflect.DeepEqual(got, test.issues) {
+						t.Errorf("got issues for %v, want %v: %v", got, test.issues, data)
+					}
+				}
+				if test.data != nil && !reflect.DeepEqual(data, test.data) {
+					t.Errorf("got data %v, want %v", data, test.data)
+				}
+				// All or nothing: none of the albums were added
+				if w := serve(h, "GET", "/albums/a3", ""); w.Code != http.StatusNotFound {
+					t.Errorf("GET /albums/a3: got status %d after a failed add, want %d", w.Code, http.StatusNotFound)
+				}
+			}
+			if !reflect.DeepEqual(hooks.before, test.before) {
+				t.Errorf("OnBeforeWrite got albums %v, want %v", hooks.before, test.before)
+			}
+		})
+	}
+}
+
+func TestAddAlbumsArtistLimit(t *testing.T) {
+	h := newTestServer(t, WithArtistRateLimit(2, time.Hour))
+	steps := []struct {
+		body   string
+		status int
+	}{
+		{`[{"id":"a3","title":"T","artist":"A","price":1},{"id":"a4","title":"T","artist":"a","price":1},{"id":"a5","title":"T","artist":"A","price":1}]`, http.StatusTooManyRequests},
+		{`[{"id":"a3","title":"T","artist":"A","price":1},{"id":"a1","title":"T","artist":"A","price":1}]`, http.StatusConflict},
+		// Neither failure above counted against the limit
+		{`[{"id":"a3","title":"T","artist":"A","price":1},{"id":"a4","title":"T","artist":"A","price":1}]`, http.StatusCreated},
+		{`{"id":"a5","title":"T","artist":"A","price":1}`, http.StatusTooManyRequests},
+		{`{"id":"a5","title":"T","artist":"B","price":1}`, http.StatusCreated},
+	}
+	for i, step := range steps {
+		w := serve(h, "POST", "/albums", step.body)
+		if w.Code != step.status {
+			t.Fatalf("step %d: got status %d, want %d: %s", i+1, w.Code, step.status, w.Body)
+		}
+	}
+}
+
+func TestArtistLimitFailedAdds(t *testing.T) {
+	hooks := &recordingHooks{reject: "rejected"}
+	h := newTestServer(t, WithArtistRateLimit(1, time.Hour), WithHooks(hooks))
+	steps := []struct {
+		body   string
+		status int
+	}{
+		{`{"id":"a1","title":"T","artist":"A","price":1}`, http.StatusConflict},
+		{`{"id":"rejected","title":"T","artist":"A","price":1}`, http.StatusBadRequest},
+		{`{"id":"a3","title":"","artist":"A","price":1}`, http.StatusBadRequest},
+		// None of the failures above counted against the limit
+		{`{"id":"a3","title":"T","artist":"A","price":1}`, http.StatusCreated},
+		{`{"id":"a4","title":"T","artist":"A","price":1}`, http.StatusTooManyRequests},
+	}
+	for i, step := range steps {
+		w := serve(h, "POST", "/albums", step.body)
+		if w.Code != step.status {
+			t.Fatalf("step %d: got status %d, want %d: %s", i+1, w.Code, step.status, w.Body)
+		}
+	}
+}
+
+func TestGeneratedIDs(t *testing.T) {
+	n := 0
+	h := newTestServer(t, WithIDGenerator(func() string {
+		n++
+		return fmt.Sprintf("gen-%d", n)
+	}))
+	tests := []struct {
+		body string
+		id   string
+	}{
+		{`{"title":"Blue Train","artist":"John Coltrane","price":5699}`, "gen-1"},
+		{`{"id":"","title":"Giant Steps","artist":"John Coltrane","price":4999}`, "gen-2"},
+		{`{"id":"mine","title":"Kind of Blue","artist":"Miles Davis","price":3999}`, "mine"},
+	}
+	for _, test := range tests {
+		w := serve(h, "POST", "/albums", test.body)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("POST %s: got status %d, want %d: %s", test.body, w.Code, http.StatusCreated, w.Body)
+		}
+		var album Album
+		if err := json.Unmarshal(w.Body.Bytes(), &album); err != nil {
+			t.Fatal(err)
+		}
+		if album.ID != test.id {
+			t.Errorf("POST %s: got ID %q in the body, want %q", test.body, album.ID, test.id)
+		}
+		if location := w.Header().Get("Location"); location != "/albums/"+test.id {
+			t.Errorf("POST %s: got Location %q, want /albums/%s", test.body, location, test.id)
+		}
+		if w := serve(h, "GET", "/albums/"+test.id, ""); w.Code != http.StatusOK {
+			t.Errorf("GET /albums/%s: got status %d, want %d", test.id, w.Code, http.StatusOK)
+		}
+	}
+}
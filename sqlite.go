@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteDatabase is a Database implementation that stores albums and
+// tracks in a SQLite database, using a pure-Go driver (no cgo).
+//
+// It uses a single connection, which serializes access but avoids
+// SQLITE_BUSY errors between connections and lets ":memory:" databases
+// work.
+type SQLiteDatabase struct {
+	db *sql.DB
+	tx *sql.Tx // set for the Database passed to a WithTx callback
+}
+
+// sqliteSchema creates the tables if they don't already exist.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS albums (
+	id         TEXT PRIMARY KEY,
+	title      TEXT NOT NULL,
+	artist     TEXT NOT NULL,
+	artist_key TEXT NOT NULL,
+	price      INTEGER NOT NULL,
+	version    INTEGER NOT NULL DEFAULT 1,
+	created_at TEXT NOT NULL DEFAULT '',
+	updated_at TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS albums_artist_key ON albums (artist_key);
+CREATE TABLE IF NOT EXISTS tracks (
+	album_id TEXT NOT NULL,
+	id       TEXT NOT NULL,
+	title    TEXT NOT NULL,
+	duration INTEGER NOT NULL,
+	position INTEGER NOT NULL,
+	PRIMARY KEY (album_id, id)
+);
+`
+
+// NewSQLiteDatabase opens the SQLite database with the given data source
+// name (a file path, or ":memory:"), creating the tables if needed.
+func NewSQLiteDatabase(dsn string) (*SQLiteDatabase, error) {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating tables: %w", err)
+	}
+	err = migrateSQLite(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating tables: %w", err)
+	}
+	return &SQLiteDatabase{db: db}, nil
+}
+
+// addedAlbumColumns are the columns of the albums table added since it was
+// first created, with their definitions.
+var addedAlbumColumns = []struct{ name, definition string }{
+	{"version", "INTEGER NOT NULL DEFAULT 1"},
+	{"created_at", "TEXT NOT NULL DEFAULT ''"},
+	{"updated_at", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// migrateSQLite adds columns missing from tables created by earlier
+// versions of sqliteSchema.
+func migrateSQLite(db *sql.DB) error {
+	for _, column := range addedAlbumColumns {
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info('albums') WHERE name = ?)", column.name).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		_, err = db.Exec("ALTER TABLE albums ADD COLUMN " + column.name + " " + column.definition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the database.
+func (d *SQLiteDatabase) Close() error {
+	return d.db.Close()
+}
+
+// querier is the query interface shared by *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// q returns the transaction if there is one, otherwise the database.
+func (d *SQLiteDatabase) q() querier {
+	if d.tx != nil {
+		return d.tx
+	}
+	return d.db
+}
+
+// inTx runs fn in the current transaction, or in a new one if there isn't
+// one, for operations made of several statements.
+func (d *SQLiteDatabase) inTx(ctx context.Context, fn func(q querier) error) error {
+	if d.tx != nil {
+		return fn(d.tx)
+	}
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqliteError(err)
+	}
+	defer tx.Rollback()
+	err = fn(tx)
+	if err != nil {
+		return err
+	}
+	return sqliteError(tx.Commit())
+}
+
+// sqliteError maps SQLite errors to the Database errors: constraint
+// violations become ErrAlreadyExists and "busy" or "locked" errors are
+// marked as transient.
+func sqliteError(err error) error {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+	switch sqliteErr.Code() {
+	case sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY, sqlite3.SQLITE_CONSTRAINT_UNIQUE:
+		return ErrAlreadyExists
+	}
+	switch sqliteErr.Code() & 0xff { // primary result code
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return fmt.Errorf("%w: %v", ErrTransient, err)
+	}
+	return err
+}
+
+const albumColumns = "id, title, artist, artist_key, price, version, created_at, updated_at"
+
+// scanAlbum scans a row of albumColumns. Timestamps are stored as RFC 3339
+// text, and are empty for albums added before they were recorded.
+func scanAlbum(scan func(dest ...any) error) (Album, error) {
+	var album Album
+	var created, updated string
+	err := scan(&album.ID, &album.Title, &album.Artist, &album.ArtistKey, &album.Price, &album.Version, &created, &updated)
+	if err != nil {
+		return Album{}, err
+	}
+	album.CreatedAt, err = parseSQLiteTime(created)
+	if err != nil {
+		return Album{}, err
+	}
+	album.UpdatedAt, err = parseSQLiteTime(updated)
+	return album, err
+}
+
+// formatSQLiteTime formats t for storing in a timestamp column, or returns
+// an empty string for the zero time.
+func formatSQLiteTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// parseSQLiteTime parses a timestamp column formatted by formatSQLiteTime.
+func parseSQLiteTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// queryAlbums runs a query that selects albumColumns.
+func (d *SQLiteDatabase) queryAlbums(ctx context.Context, query string, args ...any) ([]Album, error) {
+	rows, err := d.q().QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, sqliteError(err)
+	}
+	defer rows.Close()
+
+	albums := []Album{}
+	for rows.Next() {
+		album, err := scanAlbum(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		albums = append(albums, album)
+	}
+	return albums, sqliteError(rows.Err())
+}
+
+func (d *SQLiteDatabase) GetAlbums(ctx context.Context) ([]Album, error) {
+	return d.queryAlbums(ctx, "SELECT "+albumColumns+" FROM albums ORDER BY id")
+}
+
+func (d *SQLiteDatabase) GetAlbumsPage(ctx context.Context, offset, limit int) ([]Album, int, error) {
+	var total int
+	err := d.q().QueryRowContext(ctx, "SELECT COUNT(*) FROM albums").Scan(&total)
+	if err != nil {
+		return nil, 0, sqliteError(err)
+	}
+	albums, err := d.queryAlbums(ctx,
+		"SELECT "+albumColumns+" FROM albums ORDER BY id LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return albums, total, nil
+}
+
+// sqliteSortColumns are the ORDER BY terms for the sortable album fields.
+// Strings sort ignoring case, like sortAlbums, except IDs, which sort byte
+// for byte whether or not they're asked for.
+var sqliteSortColumns = map[string]string{
+	"":       "id",
+	"id":     "id",
+	"title":  "title COLLATE NOCASE",
+	"artist": "artist COLLATE NOCASE",
+	"price":  "price",
+}
+
+// albumFilterWhere returns the WHERE clause (or "") and its arguments for
+// selecting the albums that match filter.
+func albumFilterWhere(filter AlbumFilter) (string, []any) {
+	var where []string
+	var args []any
+	if filter.Artist != "" {
+		where = append(where, "instr(lower(artist_key), lower(?)) > 0")
+		args = append(args, filter.Artist)
+	}
+	if filter.Title != "" {
+		where = append(where, "instr(lower(title), lower(?)) > 0")
+		args = append(args, filter.Title)
+	}
+	if filter.MinPrice != nil {
+		where = append(where, "price >= ?")
+		args = append(args, *filter.MinPrice)
+	}
+	if filter.MaxPrice != nil {
+		where = append(where, "price <= ?")
+		args = append(args, *filter.MaxPrice)
+	}
+	if len(where) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+func (d *SQLiteDatabase) GetAlbumsFiltered(ctx context.Context, filter AlbumFilter) ([]Album, error) {
+	where, args := albumFilterWhere(filter)
+	return d.queryAlbums(ctx, "SELECT "+albumColumns+" FROM albums"+where+" ORDER BY id", args...)
+}
+
+func (d *SQLiteDatabase) CountAlbums(ctx context.Context, filter AlbumFilter) (int, error) {
+	where, args := albumFilterWhere(filter)
+	var n int
+	err := d.q().QueryRowContext(ctx, "SELECT COUNT(*) FROM albums"+where, args...).Scan(&n)
+	return n, sqliteError(err)
+}
+
+// EachAlbum reads the selected albums before calling fn. Streaming rows to
+// fn would hold the database's only connection while fn runs, so a slow
+// client would block every other operation, including Ping.
+func (d *SQLiteDatabase) EachAlbum(ctx context.Context, query AlbumQuery, fn func(Album) error) error {
+	order, ok := sqliteSortColumns[query.Sort]
+	if !ok {
+		return fmt.Errorf("can't sort albums by %q", query.Sort)
+	}
+	if query.Desc {
+		order += " DESC"
+	}
+	where, args := albumFilterWhere(query.Filter)
+	stmt := "SELECT " + albumColumns + " FROM albums" + where + " ORDER BY " + order + ", id"
+	if query.Limit > 0 {
+		stmt += " LIMIT ?"
+		args = append(args, query.Limit)
+	}
+	albums, err := d.queryAlbums(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	for _, album := range albums {
+		if err := fn(album); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *SQLiteDatabase) GetAlbumsByArtist(ctx context.Context, artist string) ([]Album, error) {
+	return d.queryAlbums(ctx,
+		"SELECT "+albumColumns+" FROM albums WHERE artist_key = ? ORDER BY id", artist)
+}
+
+func (d *SQLiteDatabase) GetAlbumByID(ctx context.Context, id string) (Album, error) {
+	album, err := scanAlbum(d.q().QueryRowContext(ctx, "SELECT "+albumColumns+" FROM albums WHERE id = ?", id).Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Album{}, ErrDoesNotExist
+	} else if err != nil {
+		return Album{}, sqliteError(err)
+	}
+	return album, nil
+}
+
+// AddAlbum relies on the primary key to reject duplicate IDs atomically.
+func (d *SQLiteDatabase) AddAlbum(ctx context.Context, album Album) error {
+	_, err := d.q().ExecContext(ctx,
+		"INSERT INTO albums ("+albumColumns+") VALUES (?, ?, ?, ?, ?, 1, ?, ?)",
+		album.ID, album.Title, album.Artist, album.artistKey(), album.Price,
+		formatSQLiteTime(album.CreatedAt), formatSQLiteTime(album.UpdatedAt))
+	return sqliteError(err)
+}
+
+// UpdateAlbum checks the version in the UPDATE's WHERE clause, so the check
+// and update are atomic. If no row matched, it looks up whether that was
+// because of the ID or the version.
+func (d *SQLiteDatabase) UpdateAlbum(ctx context.Context, album Album, version int) error {
+	return d.inTx(ctx, func(q querier) error {
+		result, err := q.ExecContext(ctx,
+			"UPDATE albums SET title = ?, artist = ?, artist_key = ?, price = ?, updated_at = ?, version = version + 1 WHERE id = ? AND version = ?",
+			album.Title, album.Artist, album.artistKey(), album.Price, formatSQLiteTime(album.UpdatedAt), album.ID, version)
+		if err != nil {
+			return sqliteError(err)
+		}
+		err = requireRow(result)
+		if !errors.Is(err, ErrDoesNotExist) {
+			return err
+		}
+		if err := albumExists(ctx, q, album.ID); err != nil {
+			return err
+		}
+		return ErrVersionConflict
+	})
+}
+
+func (d *SQLiteDatabase) DeleteAlbum(ctx context.Context, id string) error {
+	return d.inTx(ctx, func(q querier) error {
+		_, err := q.ExecContext(ctx, "DELETE FROM tracks WHERE album_id = ?", id)
+		if err != nil {
+			return sqliteError(err)
+		}
+		result, err := q.ExecContext(ctx, "DELETE FROM albums WHERE id = ?", id)
+		if err != nil {
+			return sqliteError(err)
+		}
+		return requireRow(result)
+	})
+}
+
+// requireRow returns ErrDoesNotExist if the statement affected no rows.
+func requireRow(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDoesNotExist
+	}
+	return nil
+}
+
+// albumExists returns ErrDoesNotExist if there's no album with the ID.
+func albumExists(ctx context.Context, q querier, id string) error {
+	var exists bool
+	err := q.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM albums WHERE id = ?)", id).Scan(&exists)
+	if err != nil {
+		return sqliteError(err)
+	}
+	if !exists {
+		return ErrDoesNotExist
+	}
+	return nil
+}
+
+func (d *SQLiteDatabase) GetTracks(ctx context.Context, albumID string) ([]Track, error) {
+	tracks := []Track{}
+	err := d.inTx(ctx, func(q querier) error {
+		err := albumExists(ctx, q, albumID)
+		if err != nil {
+			return err
+		}
+		rows, err := q.QueryContext(ctx,
+			"SELECT id, title, duration, position FROM tracks WHERE album_id = ? ORDER BY position", albumID)
+		if err != nil {
+			return sqliteError(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var track Track
+			err := rows.Scan(&track.ID, &track.Title, &track.Duration, &track.Position)
+			if err != nil {
+				return err
+			}
+			tracks = append(tracks, track)
+		}
+		return sqliteError(rows.Err())
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tracks, nil
+}
+
+func (d *SQLiteDatabase) AddTrack(ctx context.Context, albumID string, track Track, maxTracks int) (Track, error) {
+	err := d.inTx(ctx, func(q querier) error {
+		err := albumExists(ctx, q, albumID)
+		if err != nil {
+			return err
+		}
+		err = q.QueryRowContext(ctx,
+			"SELECT COUNT(*) + 1 FROM tracks WHERE album_id = ?", albumID).Scan(&track.Position)
+		if err != nil {
+			return sqliteError(err)
+		}
+		if maxTracks > 0 && track.Position > maxTracks {
+			return ErrTooManyTracks
+		}
+		_, err = q.ExecContext(ctx,
+			"INSERT INTO tracks (album_id, id, title, duration, position) VALUES (?, ?, ?, ?, ?)",
+			albumID, track.ID, track.Title, track.Duration, track.Position)
+		return sqliteError(err)
+	})
+	if err != nil {
+		return Track{}, err
+	}
+	return track, nil
+}
+
+func (d *SQLiteDatabase) ReorderTracks(ctx context.Context, albumID string, trackIDs []string) error {
+	return d.inTx(ctx, func(q querier) error {
+		err := albumExists(ctx, q, albumID)
+		if err != nil {
+			return err
+		}
+		var count int
+		err = q.QueryRowContext(ctx, "SELECT COUNT(*) FROM tracks WHERE album_id = ?", albumID).Scan(&count)
+		if err != nil {
+			return sqliteError(err)
+		}
+		if len(trackIDs) != count {
+			return ErrTrackMismatch
+		}
+
+		// Every ID must match a distinct track; the transaction is rolled
+		// back on a mismatch part way through
+		seen := make(map[string]bool, len(trackIDs))
+		for i, id := range trackIDs {
+			if seen[id] {
+				return ErrTrackMismatch
+			}
+			seen[id] = true
+			result, err := q.ExecContext(ctx,
+				"UPDATE tracks SET position = ? WHERE album_id = ? AND id = ?", i+1, albumID, id)
+			if err != nil {
+				return sqliteError(err)
+			}
+			if requireRow(result) != nil {
+				return ErrTrackMismatch
+			}
+		}
+		return nil
+	})
+}
+
+func (d *SQLiteDatabase) Ping(ctx context.Context) error {
+	return d.db.PingContext(ctx)
+}
+
+// WithTx runs fn in a SQLite transaction. Within fn, WithTx simply calls
+// the inner fn in the same transaction.
+func (d *SQLiteDatabase) WithTx(ctx context.Context, fn func(tx Database) error) error {
+	if d.tx != nil {
+		return fn(d)
+	}
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return sqliteError(err)
+	}
+	defer tx.Rollback()
+	err = fn(&SQLiteDatabase{db: d.db, tx: tx})
+	if err != nil {
+		return err
+	}
+	return sqliteError(tx.Commit())
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestSQLite opens a SQLite database in a temporary file.
+func newTestSQLite(t *testing.T) (*SQLiteDatabase, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "albums.db")
+	db, err := NewSQLiteDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, path
+}
+
+func TestSQLiteAlbums(t *testing.T) {
+	ctx := context.Background()
+	db, path := newTestSQLite(t)
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	album := Album{ID: "a1", Title: "9th Symphony", Artist: "Beethoven", ArtistKey: "beethoven", Price: 795, CreatedAt: created, UpdatedAt: created}
+
+	if err := db.AddAlbum(ctx, album); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddAlbum(ctx, album); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("adding a duplicate: got error %v, want %v", err, ErrAlreadyExists)
+	}
+	got, err := db.GetAlbumByID(ctx, "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	album.Version = 1
+	if got != album {
+		t.Errorf("got album %+v, want %+v", got, album)
+	}
+	if _, err := db.GetAlbumByID(ctx, "missing"); !errors.Is(err, ErrDoesNotExist) {
+		t.Errorf("getting a missing album: got error %v, want %v", err, ErrDoesNotExist)
+	}
+
+	updated := album
+	updated.Title = "Symphony No. 9"
+	updated.UpdatedAt = created.Add(time.Hour)
+	if err := db.UpdateAlbum(ctx, updated, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateAlbum(ctx, Album{ID: "missing"}, 1); !errors.Is(err, ErrDoesNotExist) {
+		t.Errorf("updating a missing album: got error %v, want %v", err, ErrDoesNotExist)
+	}
+
+	// The data outlives the connection
+	db.Close()
+	db, err = NewSQLiteDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	got, err = db.GetAlbumByID(ctx, "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated.Version = 2
+	if got != updated {
+		t.Errorf("after reopening, got album %+v, want %+v", got, updated)
+	}
+
+	if err := db.DeleteAlbum(ctx, "a1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteAlbum(ctx, "a1"); !errors.Is(err, ErrDoesNotExist) {
+		t.Errorf("deleting twice: got error %v, want %v", err, ErrDoesNotExist)
+	}
+	albums, err := db.GetAlbums(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(albums) != 0 {
+		t.Errorf("got %d albums after deleting, want 0", len(albums))
+	}
+}
+
+func TestSQLiteVersionConflict(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestSQLite(t)
+	album := Album{ID: "a1", Title: "T", Artist: "A", ArtistKey: "A", Price: 1}
+	if err := db.AddAlbum(ctx, album); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		version int
+		err     error
+	}{
+		{1, nil},
+		{1, ErrVersionConflict}, // now version 2
+		{3, ErrVersionConflict},
+		{2, nil},
+	}
+	for _, test := range tests {
+		if err := db.UpdateAlbum(ctx, album, test.version); !errors.Is(err, test.err) {
+			t.Errorf("update expecting version %d: got error %v, want %v", test.version, err, test.err)
+		}
+	}
+	got, err := db.GetAlbumByID(ctx, "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 3 {
+		t.Errorf("got version %d, want 3", got.Version)
+	}
+}
+
+// TestSQLiteEachAlbumReleasesConnection checks that other operations, Ping
+// included, don't wait for EachAlbum's fn.
+func TestSQLiteEachAlbumReleasesConnection(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestSQLite(t)
+	for _, id := range []string{"a1", "a2"} {
+		if err := db.AddAlbum(ctx, Album{ID: id, Title: "T", Artist: "A", ArtistKey: "A", Price: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	calls := 0
+	err := db.EachAlbum(ctx, AlbumQuery{}, func(Album) error {
+		calls++
+		ctx, cancel := context.WithTimeout(ctx, time.Second)
+		defer cancel()
+		if err := db.Ping(ctx); err != nil {
+			return err
+		}
+		_, err := db.CountAlbums(ctx, AlbumFilter{})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("fn called %d times, want 2", calls)
+	}
+}
+
+func TestSQLiteTracks(t *testing.T) {
+	ctx := context.Background()
+	db, _ := newTestSQLite(t)
+	if err := db.AddAlbum(ctx, Album{ID: "a1", Title: "T", Artist: "A", ArtistKey: "A", Price: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"t1", "t2", "t3"} {
+		if _, err := db.AddTrack(ctx, "a1", Track{ID: id, Title: id, Duration: 60}, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.AddTrack(ctx, "a1", Track{ID: "t1", Title: "t1", Duration: 60}, 0); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("adding a duplicate track: got error %v, want %v", err, ErrAlreadyExists)
+	}
+	if _, err := db.AddTrack(ctx, "missing", Track{ID: "t1", Title: "t1", Duration: 60}, 0); !errors.Is(err, ErrDoesNotExist) {
+		t.Errorf("adding a track to a missing album: got error %v, want %v", err, ErrDoesNotExist)
+	}
+
+	tests := []struct {
+		order []string
+		err   error
+		want  []string
+	}{
+		{[]string{"t3", "t1", "t2"}, nil, []string{"t3", "t1", "t2"}},
+		{[]string{"t1", "t2"}, ErrTrackMismatch, []string{"t3", "t1", "t2"}},
+		{[]string{"t1", "t2", "t4"}, ErrTrackMismatch, []string{"t3", "t1", "t2"}},
+		{[]string{"t1", "t1", "t2"}, ErrTrackMismatch, []string{"t3", "t1", "t2"}},
+		{[]string{"t2", "t3", "t1"}, nil, []string{"t2", "t3", "t1"}},
+	}
+	for _, test := range tests {
+		if err := db.ReorderTracks(ctx, "a1", test.order); !errors.Is(err, test.err) {
+			t.Errorf("reordering to %v: got error %v, want %v", test.order, err, test.err)
+		}
+		tracks, err := db.GetTracks(ctx, "a1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for i, track := range tracks {
+			ids = append(ids, track.ID)
+			if track.Position != i+1 {
+				t.Errorf("track %s has position %d, want %d", track.ID, track.Position, i+1)
+			}
+		}
+		if !slices.Equal(ids, test.want) {
+			t.Errorf("after reordering to %v: got tracks %v, want %v", test.order, ids, test.want)
+		}
+	}
+	if err := db.ReorderTracks(ctx, "missing", nil); !errors.Is(err, ErrDoesNotExist) {
+		t.Errorf("reordering a missing album: got error %v, want %v", err, ErrDoesNotExist)
+	}
+}
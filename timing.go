@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// TimingDatabase is a Database decorator that logs a warning for any
+// operation that takes longer than a threshold, to surface slow queries
+// without logging every query.
+type TimingDatabase struct {
+	db        Database
+	log       *slog.Logger
+	threshold time.Duration
+}
+
+// NewTimingDatabase wraps db so that operations taking longer than
+// threshold are logged to logger. A threshold of zero disables logging.
+func NewTimingDatabase(db Database, logger *slog.Logger, threshold time.Duration) *TimingDatabase {
+	return &TimingDatabase{db: db, log: logger, threshold: threshold}
+}
+
+// observe logs the operation if it has run for longer than the threshold,
+// with the ID of the request it's for, if any. Call it with defer and the
+// operation's start time.
+func (d *TimingDatabase) observe(ctx context.Context, op string, start time.Time) {
+	if d.threshold <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed > d.threshold {
+		logger := d.log
+		if id := RequestIDFromContext(ctx); id != "" {
+			logger = logger.With("request_id", id)
+		}
+		logger.Warn("slow database operation", "op", op, "duration_ms", float64(elapsed.Microseconds())/1000, "threshold", d.threshold.String())
+	}
+}
+
+func (d *TimingDatabase) GetAlbums(ctx context.Context) ([]Album, error) {
+	defer d.observe(ctx, "GetAlbums", time.Now())
+	return d.db.GetAlbums(ctx)
+}
+
+func (d *TimingDatabase) GetAlbumsPage(ctx context.Context, offset, limit int) ([]Album, int, error) {
+	defer d.observe(ctx, "GetAlbumsPage", time.Now())
+	return d.db.GetAlbumsPage(ctx, offset, limit)
+}
+
+func (d *TimingDatabase) GetAlbumsFiltered(ctx context.Context, filter AlbumFilter) ([]Album, error) {
+	defer d.observe(ctx, "GetAlbumsFiltered", time.Now())
+	return d.db.GetAlbumsFiltered(ctx, filter)
+}
+
+func (d *TimingDatabase) CountAlbums(ctx context.Context, filter AlbumFilter) (int, error) {
+	defer d.observe(ctx, "CountAlbums", time.Now())
+	return d.db.CountAlbums(ctx, filter)
+}
+
+// EachAlbum's duration includes the time spent in fn.
+func (d *TimingDatabase) EachAlbum(ctx context.Context, query AlbumQuery, fn func(Album) error) error {
+	defer d.observe(ctx, "EachAlbum", time.Now())
+	return d.db.EachAlbum(ctx, query, fn)
+}
+
+func (d *TimingDatabase) GetAlbumsByArtist(ctx context.Context, artist string) ([]Album, error) {
+	defer d.observe(ctx, "GetAlbumsByArtist", time.Now())
+	return d.db.GetAlbumsByArtist(ctx, artist)
+}
+
+func (d *TimingDatabase) GetAlbumByID(ctx context.Context, id string) (Album, error) {
+	defer d.observe(ctx, "GetAlbumByID", time.Now())
+	return d.db.GetAlbumByID(ctx, id)
+}
+
+func (d *TimingDatabase) AddAlbum(ctx context.Context, album Album) error {
+	defer d.observe(ctx, "AddAlbum", time.Now())
+	return d.db.AddAlbum(ctx, album)
+}
+
+func (d *TimingDatabase) UpdateAlbum(ctx context.Context, album Album, version int) error {
+	defer d.observe(ctx, "UpdateAlbum", time.Now())
+	return d.db.UpdateAlbum(ctx, album, version)
+}
+
+func (d *TimingDatabase) DeleteAlbum(ctx context.Context, id string) error {
+	defer d.observe(ctx, "DeleteAlbum", time.Now())
+	return d.db.DeleteAlbum(ctx, id)
+}
+
+func (d *TimingDatabase) GetTracks(ctx context.Context, albumID string) ([]Track, error) {
+	defer d.observe(ctx, "GetTracks", time.Now())
+	return d.db.GetTracks(ctx, albumID)
+}
+
+func (d *TimingDatabase) AddTrack(ctx context.Context, albumID string, track Track, maxTracks int) (Track, error) {
+	defer d.observe(ctx, "AddTrack", time.Now())
+	return d.db.AddTrack(ctx, albumID, track, maxTracks)
+}
+
+func (d *TimingDatabase) ReorderTracks(ctx context.Context, albumID string, trackIDs []string) error {
+	defer d.observe(ctx, "ReorderTracks", time.Now())
+	return d.db.ReorderTracks(ctx, albumID, trackIDs)
+}
+
+func (d *TimingDatabase) Ping(ctx context.Context) error {
+	defer d.observe(ctx, "Ping", time.Now())
+	return d.db.Ping(ctx)
+}
+
+func (d *TimingDatabase) WithTx(ctx context.Context, fn func(tx Database) error) error {
+	defer d.observe(ctx, "WithTx", time.Now())
+	return d.db.WithTx(ctx, fn)
+}
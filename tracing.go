@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name for the server's tracers.
+const tracerName = "github.com/dsha256/go-rest-api-std"
+
+// traceContext extracts W3C Trace Context (traceparent and tracestate
+// headers) from requests, so their spans join the caller's trace.
+var traceContext = propagation.TraceContext{}
+
+// traceRequests wraps next to handle each request in a server span named
+// after its method and route template (see routeTemplate), as a child of
+// any trace context in the request headers. The span records the method,
+// route and status code, and its status is set to error for 5xx responses.
+func (s *Server) traceRequests(next http.Handler) http.Handler {
+	tracer := s.tracerProvider.Tracer(tracerName)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		route := routeTemplate(r.URL.EscapedPath())
+		method := r.Method
+		if !standardMethods[method] {
+			method = "OTHER"
+		}
+		ctx, span := tracer.Start(ctx, method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		status := rec.Status()
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// TracingDatabase is a Database decorator that records a client span for
+// each operation, as a child of the span in the operation's context (such
+// as a request's server span), to show how much time is spent in storage.
+// Errors are recorded on the span, except ErrDoesNotExist and the like
+// that are part of normal operation (see isDatabaseFailure).
+type TracingDatabase struct {
+	db     Database
+	tracer trace.Tracer
+}
+
+// NewTracingDatabase wraps db to record spans with tracers from provider.
+func NewTracingDatabase(db Database, provider trace.TracerProvider) *TracingDatabase {
+	return &TracingDatabase{db: db, tracer: provider.Tracer(tracerName)}
+}
+
+// start starts a span for the operation. Call the returned function with
+// the operation's error when it's done.
+func (d *TracingDatabase) start(ctx context.Context, op string) (context.Context, func(error)) {
+	ctx, span := d.tracer.Start(ctx, "db."+op, trace.WithSpanKind(trace.SpanKindClient))
+	return ctx, func(err error) {
+		if isDatabaseFailure(err) {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func (d *TracingDatabase) GetAlbums(ctx context.Context) ([]Album, error) {
+	ctx, end := d.start(ctx, "GetAlbums")
+	albums, err := d.db.GetAlbums(ctx)
+	end(err)
+	return albums, err
+}
+
+func (d *TracingDatabase) GetAlbumsPage(ctx context.Context, offset, limit int) ([]Album, int, error) {
+	ctx, end := d.start(ctx, "GetAlbumsPage")
+	albums, total, err := d.db.GetAlbumsPage(ctx, offset, limit)
+	end(err)
+	return albums, total, err
+}
+
+func (d *TracingDatabase) GetAlbumsFiltered(ctx context.Context, filter AlbumFilter) ([]Album, error) {
+	ctx, end := d.start(ctx, "GetAlbumsFiltered")
+	albums, err := d.db.GetAlbumsFiltered(ctx, filter)
+	end(err)
+	return albums, err
+}
+
+func (d *TracingDatabase) CountAlbums(ctx context.Context, filter AlbumFilter) (int, error) {
+	ctx, end := d.start(ctx, "CountAlbums")
+	n, err := d.db.CountAlbums(ctx, filter)
+	end(err)
+	return n, err
+}
+
+// EachAlbum doesn't mark the span as failed for an error returned by fn,
+// which isn't the database's.
+func (d *TracingDatabase) EachAlbum(ctx context.Context, query AlbumQuery, fn func(Album) error) error {
+	ctx, end := d.start(ctx, "EachAlbum")
+	var fnErr error
+	err := d.db.EachAlbum(ctx, query, func(album Album) error {
+		fnErr = fn(album)
+		return fnErr
+	})
+	if err != nil && err == fnErr {
+		end(nil)
+	} else {
+		end(err)
+	}
+	return err
+}
+
+func (d *TracingDatabase) GetAlbumsByArtist(ctx context.Context, artist string) ([]Album, error) {
+	ctx, end := d.start(ctx, "GetAlbumsByArtist")
+	albums, err := d.db.GetAlbumsByArtist(ctx, artist)
+	end(err)
+	return albums, err
+}
+
+func (d *TracingDatabase) GetAlbumByID(ctx context.Context, id string) (Album, error) {
+	ctx, end := d.start(ctx, "GetAlbumByID")
+	album, err := d.db.GetAlbumByID(ctx, id)
+	end(err)
+	return album, err
+}
+
+func (d *TracingDatabase) AddAlbum(ctx context.Context, album Album) error {
+	ctx, end := d.start(ctx, "AddAlbum")
+	err := d.db.AddAlbum(ctx, album)
+	end(err)
+	return err
+}
+
+func (d *TracingDatabase) UpdateAlbum(ctx context.Context, album Album, version int) error {
+	ctx, end := d.start(ctx, "UpdateAlbum")
+	err := d.db.UpdateAlbum(ctx, album, version)
+	end(err)
+	return err
+}
+
+func (d *TracingDatabase) DeleteAlbum(ctx context.Context, id string) error {
+	ctx, end := d.start(ctx, "DeleteAlbum")
+	err := d.db.DeleteAlbum(ctx, id)
+	end(err)
+	return err
+}
+
+func (d *TracingDatabase) GetTracks(ctx context.Context, albumID string) ([]Track, error) {
+	ctx, end := d.start(ctx, "GetTracks")
+	tracks, err := d.db.GetTracks(ctx, albumID)
+	end(err)
+	return tracks, err
+}
+
+func (d *TracingDatabase) AddTrack(ctx context.Context, albumID string, track Track, maxTracks int) (Track, error) {
+	ctx, end := d.start(ctx, "AddTrack")
+	added, err := d.db.AddTrack(ctx, albumID, track, maxTracks)
+	end(err)
+	return added, err
+}
+
+func (d *TracingDatabase) ReorderTracks(ctx context.Context, albumID string, trackIDs []string) error {
+	ctx, end := d.start(ctx, "ReorderTracks")
+	err := d.db.ReorderTracks(ctx, albumID, trackIDs)
+	end(err)
+	return err
+}
+
+func (d *TracingDatabase) Ping(ctx context.Context) error {
+	ctx, end := d.start(ctx, "Ping")
+	err := d.db.Ping(ctx)
+	end(err)
+	return err
+}
+
+// WithTx records a span for the whole transaction, and the operations in
+// it get their own spans.
+func (d *TracingDatabase) WithTx(ctx context.Context, fn func(tx Database) error) error {
+	ctx, end := d.start(ctx, "WithTx")
+	err := d.db.WithTx(ctx, func(tx Database) error {
+		return fn(&TracingDatabase{db: tx, tracer: d.tracer})
+	})
+	end(err)
+	return err
+}
@@ -1,16 +1,70 @@
 package main
 
-import "regexp"
+import (
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
 
 // match returns true if path matches the regex pattern, and binds any
-// capturing groups in pattern to the vars.
+// capturing groups in pattern to the vars. Path should be the escaped
+// (raw) URL path, so that an encoded slash ("%2F") inside an ID doesn't
+// split path segments; each captured value is unescaped before binding.
+// Values with invalid escapes don't match.
 func match(path string, pattern *regexp.Regexp, vars ...*string) bool {
 	matches := pattern.FindStringSubmatch(path)
 	if len(matches) <= 0 {
 		return false
 	}
 	for i, match := range matches[1:] {
-		*vars[i] = match
+		value, err := url.PathUnescape(match)
+		if err != nil {
+			return false
+		}
+		*vars[i] = value
 	}
 	return true
 }
+
+// accepts reports whether the request's Accept header explicitly lists the
+// given media type (such as "application/x-ndjson") with a non-zero
+// quality. Wildcards like "*/*" don't count.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, value := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(value, ",") {
+			typ, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil || typ != mediaType {
+				continue
+			}
+			if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsEncoding reports whether the request's Accept-Encoding header
+// lists the given content coding (such as "gzip") with a non-zero quality.
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), coding) {
+				continue
+			}
+			params = strings.ReplaceAll(params, " ", "")
+			if q, ok := strings.CutPrefix(params, "q="); ok {
+				if n, err := strconv.ParseFloat(q, 64); err == nil && n == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}